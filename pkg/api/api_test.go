@@ -20,19 +20,35 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"errors"
 	"github.com/databus23/goslo.policy"
 	"github.com/golang/mock/gomock"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sapcc/maia/pkg/audit"
 	"github.com/sapcc/maia/pkg/keystone"
 	"github.com/sapcc/maia/pkg/storage"
 	"github.com/sapcc/maia/pkg/test"
+	"github.com/sapcc/maia/pkg/tracing"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/sapcc/maia/pkg/version"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
 )
 
 var projectContext = &policy.Context{Request: map[string]string{"project_id": "12345", "domain_id": "77777", "user_id": "u12345"},
@@ -45,6 +61,11 @@ var projectInsufficientRolesContext = &policy.Context{Request: map[string]string
 		"project_domain_name": "testdomain", "project_domain_id": "77777",
 		"user_id": "u12345", "user_name": "testuser", "user_domain_name": "testdomain", "user_domain_id": "77777"},
 	Roles: []string{"member"}}
+var cloudAdminContext = &policy.Context{Request: map[string]string{"project_id": "12345", "domain_id": "77777", "user_id": "u12345"},
+	Auth: map[string]string{"project_id": "12345", "project_name": "testproject",
+		"project_domain_name": "testdomain", "project_domain_id": "77777",
+		"user_id": "u12345", "user_name": "testuser", "user_domain_name": "testdomain", "user_domain_id": "77777"},
+	Roles: []string{"monitoring_viewer", "cloud_monitoring_admin"}}
 var projectHeader = map[string]string{"X-User-Id": projectContext.Auth["user_id"], "X-User-Name": projectContext.Auth["user_name"],
 	"X-User-Domain-Name": projectContext.Auth["user_domain_name"],
 	"X-Project-Id":       projectContext.Auth["project_id"], "X-Project-Name": projectContext.Auth["project_name"]}
@@ -74,7 +95,7 @@ func setupTest(t *testing.T, controller *gomock.Controller) (http.Handler, *keys
 func expectAuthByProjectID(keystoneMock *keystone.MockDriver) {
 	httpReqMatcher := test.HTTPRequestMatcher{InjectHeader: projectHeader}
 	authCall := keystoneMock.EXPECT().AuthenticateRequest(httpReqMatcher, false).Return(projectContext, nil)
-	keystoneMock.EXPECT().ChildProjects(projectContext.Auth["project_id"]).Return([]string{}, nil).After(authCall)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), projectContext.Auth["project_id"]).Return([]string{}, nil).After(authCall)
 }
 
 func expectAuthByDomainName(keystoneMock *keystone.MockDriver) {
@@ -85,13 +106,13 @@ func expectAuthByDomainName(keystoneMock *keystone.MockDriver) {
 func expectAuthWithChildren(keystoneMock *keystone.MockDriver) {
 	httpReqMatcher := test.HTTPRequestMatcher{InjectHeader: projectHeader}
 	authCall := keystoneMock.EXPECT().AuthenticateRequest(httpReqMatcher, false).Return(projectContext, nil)
-	keystoneMock.EXPECT().ChildProjects(projectContext.Auth["project_id"]).Return([]string{"67890"}, nil).After(authCall)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), projectContext.Auth["project_id"]).Return([]string{"67890"}, nil).After(authCall)
 }
 
 func expectAuthByDefaults(keystoneMock *keystone.MockDriver) {
 	httpReqMatcher := test.HTTPRequestMatcher{InjectHeader: projectHeader}
 	authCall := keystoneMock.EXPECT().AuthenticateRequest(httpReqMatcher, true).Return(projectContext, nil)
-	keystoneMock.EXPECT().UserProjects(projectContext.Auth["user_id"]).Return([]tokens.Scope{{ProjectID: projectContext.Auth["project_id"], DomainID: projectContext.Auth["project_domain_id"]}}, nil).After(authCall)
+	keystoneMock.EXPECT().UserProjects(gomock.Any(), projectContext.Auth["user_id"]).Return([]tokens.Scope{{ProjectID: projectContext.Auth["project_id"], DomainID: projectContext.Auth["project_domain_id"]}}, nil).After(authCall)
 }
 
 func expectAuthAndFail(keystoneMock *keystone.MockDriver) {
@@ -109,8 +130,52 @@ func expectAuthAndDenyAuthorization(keystoneMock *keystone.MockDriver) {
 	keystoneMock.EXPECT().AuthenticateRequest(httpReqMatcher, false).Return(projectInsufficientRolesContext, nil)
 }
 
+// enableLabelRules configures the redaction of scrape labels used in the fixtures
+func enableLabelRules() func() {
+	viper.Set("maia.redact_labels", "instance,job")
+	viper.Set("maia.rename_labels", "kubernetes_namespace=namespace,exported_instance=instance")
+	return func() {
+		viper.Set("maia.redact_labels", "")
+		viper.Set("maia.rename_labels", "")
+	}
+}
+
 // HTTP based tests
 
+// auditSink passes the events of the auditor installed by enableAuditing to a channel
+type auditSink struct {
+	events chan audit.Event
+}
+
+func (s auditSink) Send(events []audit.Event) error {
+	for _, e := range events {
+		s.events <- e
+	}
+	return nil
+}
+
+// enableAuditing installs an auditor which delivers every event immediately
+func enableAuditing() (chan audit.Event, func()) {
+	sink := auditSink{events: make(chan audit.Event, 10)}
+	auditor = audit.New(sink, 10, 1, time.Millisecond, audit.BackpressureBlock, 0, 0)
+	return sink.events, func() { auditor = nil }
+}
+
+// expectAuditEvent waits for the next audit event and returns its attachments by name
+func expectAuditEvent(t *testing.T, events chan audit.Event) (audit.Event, map[string]interface{}) {
+	select {
+	case e := <-events:
+		attachments := map[string]interface{}{}
+		for _, a := range e.Attachments {
+			attachments[a.Name] = a.Content
+		}
+		return e, attachments
+	case <-time.After(time.Second):
+		t.Fatal("audit event has not been recorded")
+	}
+	return audit.Event{}, nil
+}
+
 func TestFederate(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -118,7 +183,65 @@ func TestFederate(t *testing.T) {
 	router, keystoneMock, storageMock := setupTest(t, ctrl)
 
 	expectAuthByDomainName(keystoneMock)
-	storageMock.EXPECT().Federate([]string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.PlainText).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
+		Method:           "GET",
+		Path:             "/federate?match[]={vmware_name=%22win_cifs_13%22}",
+		ExpectStatusCode: http.StatusOK,
+		ExpectFile:       "fixtures/federate.txt",
+	}.Check(t, router)
+}
+
+func TestFederate_audit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	expectAuthByDomainName(keystoneMock)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
+		Method:           "GET",
+		Path:             "/federate?match[]={vmware_name=%22win_cifs_13%22}",
+		ExpectStatusCode: http.StatusOK,
+		ExpectFile:       "fixtures/federate.txt",
+	}.Check(t, router)
+
+	e, attachments := expectAuditEvent(t, events)
+	if e.Action != audit.ActionRead || e.Outcome != audit.OutcomeSuccess || e.Reason.ReasonCode != "200" {
+		t.Errorf("unexpected action, outcome or reason: %s %s %+v", e.Action, e.Outcome, e.Reason)
+	}
+	if e.Target.ID != "77777" || e.Initiator.ID != "u12345" || e.RequestPath != "/federate" {
+		t.Errorf("unexpected target, initiator or path: %+v %+v %s", e.Target, e.Initiator, e.RequestPath)
+	}
+	if q := attachments["query"].([]string); len(q) != 1 || q[0] != "{vmware_name=\"win_cifs_13\"}" {
+		t.Errorf("unexpected original selectors: %v", q)
+	}
+	if q := attachments["rewritten_query"].([]string); len(q) != 1 || q[0] != "{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}" {
+		t.Errorf("unexpected rewritten selectors: %v", q)
+	}
+	if size := attachments["response_size"].(int); size <= 0 {
+		t.Errorf("expected response size to be recorded, got %d", size)
+	}
+}
+
+func TestFederate_domainScopeIncludesProjects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.domain_scope_includes_projects", true)
+	defer viper.Set("maia.domain_scope_includes_projects", false)
+
+	expectAuthByDomainName(keystoneMock)
+	keystoneMock.EXPECT().DomainProjects(gomock.Any(), "77777").Return([]string{"12345", "67890"}, nil)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}", "{vmware_name=\"win_cifs_13\",project_id=~\"12345|67890\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
 
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
@@ -129,6 +252,145 @@ func TestFederate(t *testing.T) {
 	}.Check(t, router)
 }
 
+func TestFederate_redactLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthByDomainName(keystoneMock)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
+		Method:           "GET",
+		Path:             "/federate?match[]={vmware_name=%22win_cifs_13%22}",
+		ExpectStatusCode: http.StatusOK,
+		ExpectFile:       "fixtures/federate_redacted.txt",
+	}.Check(t, router)
+}
+
+func TestFederate_externalLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	// labels of the series take precedence
+	viper.Set("maia.federate_external_labels", "maia_region=eu-de-1,region=other")
+	defer viper.Set("maia.federate_external_labels", "")
+
+	expectAuthByDomainName(keystoneMock)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
+		Method:           "GET",
+		Path:             "/federate?match[]={vmware_name=%22win_cifs_13%22}",
+		ExpectStatusCode: http.StatusOK,
+		ExpectFile:       "fixtures/federate_external_labels.txt",
+	}.Check(t, router)
+}
+
+func TestFederate_seriesLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.federate_max_series", 3)
+	defer viper.Set("maia.federate_max_series", 0)
+
+	expectAuthByDomainName(keystoneMock)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
+		Method:           "GET",
+		Path:             "/federate?match[]={vmware_name=%22win_cifs_13%22}",
+		ExpectStatusCode: http.StatusUnprocessableEntity,
+	}.Check(t, router)
+}
+
+func TestFederate_seriesLimitProtobuf(t *testing.T) {
+	gauge := dto.MetricType_GAUGE
+	families := []*dto.MetricFamily{}
+	for _, name := range []string{"vcenter_cpu_costop_summation", "vcenter_cpu_ready_summation"} {
+		name := name
+		mf := &dto.MetricFamily{Name: &name, Help: &name, Type: &gauge}
+		for _, instance := range []string{"a", "b", "c"} {
+			instanceName, instance, value := "instance", instance, 1.0
+			mf.Metric = append(mf.Metric, &dto.Metric{Label: []*dto.LabelPair{{Name: &instanceName, Value: &instance}}, Gauge: &dto.Gauge{Value: &value}})
+		}
+		families = append(families, mf)
+	}
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range families {
+		if err := encoder.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	response := func() *http.Response {
+		return &http.Response{Header: http.Header{"Content-Type": []string{string(expfmt.FmtProtoDelim)}}, Body: io.NopCloser(bytes.NewReader(buf.Bytes()))}
+	}
+
+	decoded, err := decodeMetricFamilies(response(), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(families) {
+		t.Fatalf("expected %d metric families, got %d", len(families), len(decoded))
+	}
+	for i := range families {
+		if !proto.Equal(families[i], decoded[i]) {
+			t.Errorf("metric family has not been decoded correctly: %v", decoded[i])
+		}
+	}
+
+	// the limit is enforced while decoding the second family
+	if _, err := decodeMetricFamilies(response(), 4); err == nil {
+		t.Error("series limit has not been enforced")
+	} else if _, ok := err.(seriesLimitError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFederate_contentNegotiation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	for _, accept := range []string{storage.P8SProtoBuf, storage.OpenMetrics} {
+		expectAuthByDomainName(keystoneMock)
+		storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+
+		request := httptest.NewRequest("GET", "/federate?match[]={vmware_name=%22win_cifs_13%22}", nil)
+		request.Header.Set("Authorization", base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")))
+		request.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d", accept, http.StatusOK, recorder.Code)
+		}
+		contentType := recorder.Header().Get("Content-Type")
+		switch {
+		case strings.HasPrefix(contentType, "application/vnd.google.protobuf"):
+			mf := &dto.MetricFamily{}
+			if err := expfmt.NewDecoder(recorder.Body, expfmt.FmtProtoDelim).Decode(mf); err != nil || len(mf.Metric) != 4 {
+				t.Errorf("%s: could not decode 4 series from response (%v)", accept, err)
+			}
+		case strings.HasPrefix(contentType, "application/openmetrics-text"):
+			if body := recorder.Body.String(); !strings.HasSuffix(body, "# EOF\n") || !strings.Contains(body, "vmware_name=\"win_cifs_13\"") {
+				t.Errorf("%s: unexpected OpenMetrics response: %s", accept, body)
+			}
+		default:
+			t.Errorf("%s: unexpected response format %s", accept, contentType)
+		}
+	}
+}
+
 func TestFederate_errorNoMatch(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -168,7 +430,7 @@ func TestFederate_errorBackendFailed(t *testing.T) {
 	router, keystoneMock, storageMock := setupTest(t, ctrl)
 
 	expectAuthByDomainName(keystoneMock)
-	storageMock.EXPECT().Federate([]string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.PlainText).Return(nil, errors.New("testerror"))
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{vmware_name=\"win_cifs_13\",domain_id=\"77777\"}"}, storage.P8SProtoBuf).Return(nil, errors.New("testerror"))
 
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.PlainText},
@@ -185,7 +447,7 @@ func TestSeries(t *testing.T) {
 	router, keystoneMock, storageMock := setupTest(t, ctrl)
 
 	expectAuthWithChildren(keystoneMock)
-	storageMock.EXPECT().Series([]string{"{component!=\"\",project_id=~\"12345|67890\"}"}, "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{component!=\"\",project_id=~\"12345|67890\"}"}, "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
 	test.APIRequest{
 		Headers:          map[string]string{"X-Auth-Token": "someverylongtokenideed", "Accept": storage.JSON},
@@ -196,6 +458,59 @@ func TestSeries(t *testing.T) {
 	}.Check(t, router)
 }
 
+func TestSeries_audit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	expectAuthWithChildren(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{component!=\"\",project_id=~\"12345|67890\"}"}, "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", storage.JSON).Return(nil, errors.New("testerror"))
+
+	test.APIRequest{
+		Headers:          map[string]string{"X-Auth-Token": "someverylongtokenideed", "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/series?match[]={component!=%22%22}&end=2017-07-02T04:00:00.000Z&start=2017-07-01T20:10:30.781Z",
+		ExpectStatusCode: http.StatusBadGateway,
+	}.Check(t, router)
+
+	e, attachments := expectAuditEvent(t, events)
+	if e.Action != audit.ActionList || e.Outcome != audit.OutcomeFailure || e.Reason.ReasonCode != "502" {
+		t.Errorf("unexpected action, outcome or reason: %s %s %+v", e.Action, e.Outcome, e.Reason)
+	}
+	if e.Target.ID != "12345" {
+		t.Errorf("expected project 12345 as target, got %+v", e.Target)
+	}
+	if children := attachments["child_projects"].([]string); len(children) != 1 || children[0] != "67890" {
+		t.Errorf("unexpected child projects: %v", children)
+	}
+	if q := attachments["rewritten_query"].([]string); len(q) != 1 || q[0] != "{component!=\"\",project_id=~\"12345|67890\"}" {
+		t.Errorf("unexpected rewritten selectors: %v", q)
+	}
+}
+
+func TestSeries_redactLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthWithChildren(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{component!=\"\",project_id=~\"12345|67890\"}"}, "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
+
+	// series only differing in the instance are merged
+	test.APIRequest{
+		Headers:          map[string]string{"X-Auth-Token": "someverylongtokenideed", "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/series?match[]={component!=%22%22}&end=2017-07-02T04:00:00.000Z&start=2017-07-01T20:10:30.781Z",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/series_redacted.json",
+	}.Check(t, router)
+}
+
 func TestSeries_failAuthentication(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -235,7 +550,7 @@ func TestLabelValues(t *testing.T) {
 	expectAuthByProjectID(keystoneMock)
 	// Maia's label-values implementation uses the series API and a time-based filter stale series out. The exact start
 	// and end date of the filter cannot be predicted, therefore we accept anything that is a parsable date.
-	storageMock.EXPECT().Series([]string{"{component!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{component!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
@@ -246,153 +561,1209 @@ func TestLabelValues(t *testing.T) {
 	}.Check(t, router)
 }
 
-func TestQuery(t *testing.T) {
+func TestLabelValues_renamedLabel(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
 
 	expectAuthByProjectID(keystoneMock)
-	storageMock.EXPECT().Query("sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{namespace!=\"\",project_id=\"12345\"}", "{kubernetes_namespace!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		Path:             "/api/v1/label/namespace/values",
 		ExpectStatusCode: http.StatusOK,
-		ExpectJSON:       "fixtures/query.json",
+		ExpectJSON:       "fixtures/label_values_renamed.json",
 	}.Check(t, router)
 }
 
-func TestQuery_syntaxError(t *testing.T) {
+func TestLabelValues_redactedLabel(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	router, keystoneMock, _ := setupTest(t, ctrl)
+	defer enableLabelRules()()
 
+	// the backend is not even asked
 	expectAuthByProjectID(keystoneMock)
 
+	body := `{"status":"success","data":[]}`
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22}&time=2017-07-01T20:10:30.781Z&timeout=24m",
-		ExpectStatusCode: 400,
-		ExpectJSON:       "fixtures/query_syntax_error.json",
+		Path:             "/api/v1/label/job/values",
+		ExpectStatusCode: http.StatusOK,
+		ExpectBody:       &body,
 	}.Check(t, router)
 }
 
-func TestQueryRange(t *testing.T) {
+func TestLabelValues_metricVisibility(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("metric_visibility.monitoring_viewer.deny", "billing_.*")
+	defer viper.Set("metric_visibility.monitoring_viewer", nil)
 
 	expectAuthByProjectID(keystoneMock)
-	storageMock.EXPECT().QueryRange("sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", "5m", "90s", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_range.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{__name__!=\"\",__name__!~\"billing_.*\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
+	body := `{"status":"success","data":["up"]}`
 	test.APIRequest{
 		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/api/v1/query_range?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&end=2017-07-02T04:00:00.000Z&start=2017-07-01T20:10:30.781Z&step=5m&timeout=90s",
+		Path:             "/api/v1/label/__name__/values",
 		ExpectStatusCode: http.StatusOK,
-		ExpectJSON:       "fixtures/query_range.json",
+		ExpectBody:       &body,
 	}.Check(t, router)
 }
 
-func TestAPIMetadata(t *testing.T) {
+func TestQuery(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	router, keystoneMock, _ := setupTest(t, ctrl)
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
 
-	keystoneMock.EXPECT().ServiceURL().Return("http://localhost:9091/api/v1")
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/api",
-		ExpectStatusCode: 300,
-		ExpectJSON:       "fixtures/api-metadata.json",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
 	}.Check(t, router)
 }
 
-func TestServeStaticContent(t *testing.T) {
+func TestQuery_audit(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	router, _, _ := setupTest(t, ctrl)
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	expectAuthWithChildren(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=~\"12345|67890\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/static/css/graph.css",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
 		ExpectStatusCode: http.StatusOK,
-		ExpectFile:       "../../web/static/css/graph.css",
+		ExpectJSON:       "fixtures/query.json",
 	}.Check(t, router)
+
+	e, attachments := expectAuditEvent(t, events)
+	if e.Action != audit.ActionRead || e.Outcome != audit.OutcomeSuccess || e.Reason.ReasonCode != "200" {
+		t.Errorf("unexpected action, outcome or reason: %s %s %+v", e.Action, e.Outcome, e.Reason)
+	}
+	if e.Target.ID != "12345" || e.Initiator.ID != "u12345" || e.RequestPath != "/query" {
+		t.Errorf("unexpected target, initiator or path: %+v %+v %s", e.Target, e.Initiator, e.RequestPath)
+	}
+	if children := attachments["child_projects"].([]string); len(children) != 1 || children[0] != "67890" {
+		t.Errorf("unexpected child projects: %v", children)
+	}
+	if q := attachments["query"].([]string); len(q) != 1 || q[0] != "sum(blackbox_api_status_gauge{check=~\"keystone\"})" {
+		t.Errorf("unexpected original query: %v", q)
+	}
+	if q := attachments["rewritten_query"].([]string); len(q) != 1 || q[0] != "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=~\"12345|67890\"})" {
+		t.Errorf("unexpected rewritten query: %v", q)
+	}
+	if attachments["unrestricted"].(bool) {
+		t.Error("query restricted to the scope must not be recorded as unrestricted")
+	}
+	if size := attachments["response_size"].(int); size <= 0 {
+		t.Errorf("expected response size to be recorded, got %d", size)
+	}
 }
 
-func TestServeStaticContent_notFound(t *testing.T) {
+func TestQuery_redactLabels(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	router, _, _ := setupTest(t, ctrl)
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "up{project_id=\"12345\"}", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_labels.json"), nil)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/static/bla.xyz",
-		ExpectStatusCode: http.StatusNotFound,
+		Path:             "/api/v1/query?query=up&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query_redacted.json",
 	}.Check(t, router)
 }
 
-func TestGraph(t *testing.T) {
+func TestQuery_redactedDuplicates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	// the samples only differ in the redacted instance label
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "up{project_id=\"12345\"}", "2017-07-01T20:10:30.781Z", "", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_duplicates.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=up&time=2017-07-01T20:10:30.781Z",
+		ExpectStatusCode: http.StatusUnprocessableEntity,
+	}.Check(t, router)
+}
+
+func TestQueryRange_redactedDuplicates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().QueryRange(gomock.Any(), "up{project_id=\"12345\"}", "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", "5m", "", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_range_duplicates.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query_range?query=up&end=2017-07-02T04:00:00.000Z&start=2017-07-01T20:10:30.781Z&step=5m",
+		ExpectStatusCode: http.StatusUnprocessableEntity,
+	}.Check(t, router)
+}
+
+func TestQuery_redactedLabelCopied(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	router, keystoneMock, _ := setupTest(t, ctrl)
-	expectAuthByDefaults(keystoneMock)
+	defer enableLabelRules()()
+
+	expectAuthByProjectID(keystoneMock)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/testdomain/graph?project_id=" + projectContext.Auth["project_id"],
+		Path:             "/api/v1/query?query=" + url.QueryEscape("label_replace(up, \"host\", \"$1\", \"instance\", \"(.*)\")") + "&time=2017-07-01T20:10:30.781Z",
+		ExpectStatusCode: http.StatusForbidden,
+	}.Check(t, router)
+}
+
+func TestQueryExemplars(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().QueryExemplars(gomock.Any(), "http_request_duration_seconds_bucket{project_id=\"12345\"}", "2017-07-03T07:26:00Z", "2017-07-03T07:27:00Z", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_exemplars.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query_exemplars?query=http_request_duration_seconds_bucket&start=2017-07-03T07:26:00Z&end=2017-07-03T07:27:00Z",
 		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query_exemplars.json",
 	}.Check(t, router)
 }
 
-func TestRoot_redirect(t *testing.T) {
+func TestQueryExemplars_redactLabels(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	router, _, _ := setupTest(t, ctrl)
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().QueryExemplars(gomock.Any(), "http_request_duration_seconds_bucket{project_id=\"12345\"}", "2017-07-03T07:26:00Z", "2017-07-03T07:27:00Z", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_exemplars.json"), nil)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/" + projectContext.Auth["project_id"],
-		ExpectStatusCode: http.StatusFound,
+		Path:             "/api/v1/query_exemplars?query=http_request_duration_seconds_bucket&start=2017-07-03T07:26:00Z&end=2017-07-03T07:27:00Z",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query_exemplars_redacted.json",
 	}.Check(t, router)
 }
 
-func TestGraph_redirect(t *testing.T) {
+func TestQueryExemplars_syntaxError(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	router, _, _ := setupTest(t, ctrl)
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
 
 	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/graph?project_id=" + projectContext.Auth["project_id"],
-		ExpectStatusCode: http.StatusFound,
+		Path:             "/api/v1/query_exemplars?query=sum(",
+		ExpectStatusCode: http.StatusBadRequest,
 	}.Check(t, router)
 }
 
-func TestGraph_otherOSDomain(t *testing.T) {
+func TestExplain(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	router, keystoneMock, _ := setupTest(t, ctrl)
-	expectPlainBasicAuthAndFail(keystoneMock)
+
+	// the query must not be executed, so there are no expectations on the storage
+	expectAuthWithChildren(keystoneMock)
 
 	test.APIRequest{
-		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic testuser|12345:password")), "Accept": storage.JSON},
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
 		Method:           "GET",
-		Path:             "/nottestdomain/graph?project_id=" + projectContext.Auth["project_id"],
-		ExpectStatusCode: http.StatusUnauthorized,
+		Path:             "/api/v1/explain?query=sum(rate(http_requests_total{job%3D%22api%22}[7d]))",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/explain.json",
+	}.Check(t, router)
+}
+
+func TestExplain_audit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	expectAuthWithChildren(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/explain?query=up",
+		ExpectStatusCode: http.StatusOK,
+	}.Check(t, router)
+
+	e, attachments := expectAuditEvent(t, events)
+	if e.RequestPath != "/explain" || e.Reason.ReasonCode != "200" {
+		t.Errorf("unexpected path or reason: %s %+v", e.RequestPath, e.Reason)
+	}
+	if children := attachments["child_projects"].([]string); len(children) != 1 || children[0] != "67890" {
+		t.Errorf("unexpected child projects: %v", children)
+	}
+}
+
+func TestExplain_scopeViolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/explain?query=up{project_id%3D%2299999%22}",
+		ExpectStatusCode: http.StatusForbidden,
+	}.Check(t, router)
+}
+
+func TestCardinality(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.cardinality_cache_ttl", "5m")
+	defer viper.Set("maia.cardinality_cache_ttl", "")
+
+	// the second request is answered from the cache
+	expectAuthByProjectID(keystoneMock)
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{__name__!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/cardinality_series.json"), nil).Times(1)
+
+	for i := 0; i < 2; i++ {
+		test.APIRequest{
+			Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+			Method:           "GET",
+			Path:             "/api/v1/cardinality?limit=2",
+			ExpectStatusCode: http.StatusOK,
+			ExpectJSON:       "fixtures/cardinality.json",
+		}.Check(t, router)
+	}
+}
+
+func TestCardinality_maxSeries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.cardinality_max_series", 2)
+	defer viper.Set("maia.cardinality_max_series", 0)
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{__name__!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/cardinality_series.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/cardinality",
+		ExpectStatusCode: http.StatusUnprocessableEntity,
+	}.Check(t, router)
+}
+
+func TestCardinality_audit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{__name__!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/cardinality_series.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/cardinality?limit=2",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/cardinality.json",
+	}.Check(t, router)
+
+	e, attachments := expectAuditEvent(t, events)
+	if e.Action != audit.ActionList || e.RequestPath != "/cardinality" || e.Reason.ReasonCode != "200" {
+		t.Errorf("unexpected action, path or reason: %s %s %+v", e.Action, e.RequestPath, e.Reason)
+	}
+	if q := attachments["rewritten_query"].([]string); len(q) != 1 || q[0] != "{__name__!=\"\",project_id=\"12345\"}" {
+		t.Errorf("unexpected rewritten selectors: %v", q)
+	}
+}
+
+func TestCardinality_redactLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	defer enableLabelRules()()
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{__name__!=\"\",project_id=\"12345\"}"}, test.TimeStringMatcher{}, test.TimeStringMatcher{}, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/cardinality_series.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/cardinality",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/cardinality_redacted.json",
+	}.Check(t, router)
+}
+
+func TestCardinality_invalidLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/cardinality?limit=-1",
+		ExpectStatusCode: http.StatusBadRequest,
+	}.Check(t, router)
+}
+
+func TestQuery_invalidRenameRule(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	viper.Set("maia.rename_labels", "kubernetes_namespace")
+	defer viper.Set("maia.rename_labels", "")
+
+	expectAuthByProjectID(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=up&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusInternalServerError,
+	}.Check(t, router)
+}
+
+func TestQuery_metricVisibility(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("metric_visibility.monitoring_viewer.allow", "openstack_.*,limes_.*")
+	defer viper.Set("metric_visibility.monitoring_viewer", nil)
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum({__name__=~\"limes_.*\",__name__=~\"limes_.*|openstack_.*\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum({__name__%3D~%22limes_.*%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+}
+
+func TestQuery_deniedMetric(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	viper.Set("metric_visibility.monitoring_viewer.deny", "billing_.*")
+	defer viper.Set("metric_visibility.monitoring_viewer", nil)
+
+	expectAuthByProjectID(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(billing_invoices)&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusForbidden,
+		ExpectJSON:       "fixtures/query_forbidden_metric.json",
+	}.Check(t, router)
+}
+
+func TestQuery_scopeViolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=up{project_id%3D%2299999%22}&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusForbidden,
+		ExpectJSON:       "fixtures/query_scope_violation.json",
+	}.Check(t, router)
+}
+
+func TestQuery_domainScopeIncludesProjects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.domain_scope_includes_projects", true)
+	defer viper.Set("maia.domain_scope_includes_projects", false)
+
+	expectAuthByDomainName(keystoneMock)
+	keystoneMock.EXPECT().DomainProjects(gomock.Any(), "77777").Return([]string{"12345"}, nil)
+	storageMock.EXPECT().Query(gomock.Any(), "sum((blackbox_api_status_gauge{check=~\"keystone\",domain_id=\"77777\"} or blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"}))", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic u12345|@77777:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+}
+
+func TestQuery_showAll(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("keystone.show_all_rule", "metric:show_all")
+	defer viper.Set("keystone.show_all_rule", "")
+
+	// no label constraint, so the project tree is not needed
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(cloudAdminContext, nil)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",domain_id=~\"77777|88888\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22,domain_id%3D~%2277777%7C88888%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+}
+
+func TestQuery_showAllAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("keystone.show_all_rule", "metric:show_all")
+	defer viper.Set("keystone.show_all_rule", "")
+	events, disableAuditing := enableAuditing()
+	defer disableAuditing()
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(cloudAdminContext, nil)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge)", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge)&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+
+	_, attachments := expectAuditEvent(t, events)
+	if !attachments["unrestricted"].(bool) {
+		t.Error("query of a cloud admin must be recorded as unrestricted")
+	}
+}
+
+func TestQuery_showAllNotRedacted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("keystone.show_all_rule", "metric:show_all")
+	defer viper.Set("keystone.show_all_rule", "")
+	defer enableLabelRules()()
+
+	// cloud admins see the labels of the infrastructure
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(cloudAdminContext, nil)
+	storageMock.EXPECT().Query(gomock.Any(), "up", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_labels.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=up&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query_labels.json",
+	}.Check(t, router)
+}
+
+func TestQuery_showAllNotPermitted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("keystone.show_all_rule", "metric:show_all")
+	defer viper.Set("keystone.show_all_rule", "")
+
+	// the scope is enforced for everybody else
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",domain_id=\"88888\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22,domain_id%3D%2288888%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+}
+
+func TestQuery_multiProject(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.multi_project_queries", true)
+	defer viper.Set("maia.multi_project_queries", false)
+
+	authCall := keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	keystoneMock.EXPECT().UserProjects(gomock.Any(), "u12345").Return([]tokens.Scope{{ProjectID: "12345"}, {DomainID: "77777"}, {ProjectID: "abcde"}}, nil).After(authCall)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), "12345").Return([]string{"67890"}, nil).After(authCall)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), "abcde").Return([]string{}, nil).After(authCall)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=~\"12345|67890|abcde\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&project_id=12345&project_id=abcde&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+}
+
+func TestQuery_multiProjectForbidden(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	viper.Set("maia.multi_project_queries", true)
+	defer viper.Set("maia.multi_project_queries", false)
+
+	authCall := keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	keystoneMock.EXPECT().UserProjects(gomock.Any(), "u12345").Return([]tokens.Scope{{ProjectID: "12345"}}, nil).After(authCall)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), "12345").Return([]string{}, nil).AnyTimes()
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&project_id=12345&project_id=abcde&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusForbidden,
+		ExpectJSON:       "fixtures/query_forbidden_project.json",
+	}.Check(t, router)
+}
+
+func TestQuery_syntaxError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22}&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: 400,
+		ExpectJSON:       "fixtures/query_syntax_error.json",
+	}.Check(t, router)
+}
+
+func TestQueryRange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().QueryRange(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "2017-07-02T04:00:00.000Z", "5m", "90s", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_range.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query_range?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&end=2017-07-02T04:00:00.000Z&start=2017-07-01T20:10:30.781Z&step=5m&timeout=90s",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query_range.json",
+	}.Check(t, router)
+}
+
+func TestAPIMetadata(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().ServiceURL().Return("http://localhost:9091/api/v1")
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/api",
+		ExpectStatusCode: 300,
+		ExpectJSON:       "fixtures/api-metadata.json",
+	}.Check(t, router)
+}
+
+func TestServeStaticContent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, _, _ := setupTest(t, ctrl)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/static/css/graph.css",
+		ExpectStatusCode: http.StatusOK,
+		ExpectFile:       "../../web/static/css/graph.css",
+	}.Check(t, router)
+}
+
+func TestServeStaticContent_notFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, _, _ := setupTest(t, ctrl)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/static/bla.xyz",
+		ExpectStatusCode: http.StatusNotFound,
+	}.Check(t, router)
+}
+
+func TestGraph(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	expectAuthByDefaults(keystoneMock)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/testdomain/graph?project_id=" + projectContext.Auth["project_id"],
+		ExpectStatusCode: http.StatusOK,
+	}.Check(t, router)
+}
+
+func TestRoot_redirect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, _, _ := setupTest(t, ctrl)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/" + projectContext.Auth["project_id"],
+		ExpectStatusCode: http.StatusFound,
+	}.Check(t, router)
+}
+
+func TestGraph_redirect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, _, _ := setupTest(t, ctrl)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/graph?project_id=" + projectContext.Auth["project_id"],
+		ExpectStatusCode: http.StatusFound,
+	}.Check(t, router)
+}
+
+func TestGraph_otherOSDomain(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+	expectPlainBasicAuthAndFail(keystoneMock)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Authorization": base64.StdEncoding.EncodeToString([]byte("Basic testuser|12345:password")), "Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/nottestdomain/graph?project_id=" + projectContext.Auth["project_id"],
+		ExpectStatusCode: http.StatusUnauthorized,
+	}.Check(t, router)
+}
+
+func TestBuildInfo(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	storageMock.EXPECT().Status(gomock.Any(), "buildinfo", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/backend_buildinfo.json"), nil)
+
+	request := httptest.NewRequest("GET", "/api/v1/status/buildinfo", nil)
+	request.Header.Set("X-Auth-Token", "someverylongtokenideed")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var result struct {
+		Status storage.Status `json:"status"`
+		Data   buildInfoData  `json:"data"`
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Data.Version != "2.37.0" {
+		t.Errorf("expected backend version 2.37.0, got %s", result.Data.Version)
+	}
+	if result.Data.Maia != version.BuildInfo() {
+		t.Errorf("expected Maia build info %v, got %v", version.BuildInfo(), result.Data.Maia)
+	}
+}
+
+func TestBuildInfo_backendDown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	storageMock.EXPECT().Status(gomock.Any(), "buildinfo", storage.JSON).Return(nil, errors.New("testerror"))
+
+	request := httptest.NewRequest("GET", "/api/v1/status/buildinfo", nil)
+	request.Header.Set("X-Auth-Token", "someverylongtokenideed")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var result struct {
+		Status storage.Status `json:"status"`
+		Data   buildInfoData  `json:"data"`
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Data.Version != "" {
+		t.Errorf("expected empty backend version, got %s", result.Data.Version)
+	}
+	if result.Data.Maia != version.BuildInfo() {
+		t.Errorf("expected Maia build info %v, got %v", version.BuildInfo(), result.Data.Maia)
+	}
+}
+
+func TestRuntimeInfo(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+
+	request := httptest.NewRequest("GET", "/api/v1/status/runtimeinfo", nil)
+	request.Header.Set("X-Auth-Token", "someverylongtokenideed")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var result struct {
+		Status storage.Status `json:"status"`
+		Data   struct {
+			StartTime      time.Time `json:"startTime"`
+			GoroutineCount int       `json:"goroutineCount"`
+			GOMAXPROCS     int       `json:"GOMAXPROCS"`
+		} `json:"data"`
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != storage.StatusSuccess {
+		t.Errorf("expected status %s, got %s", storage.StatusSuccess, result.Status)
+	}
+	if !result.Data.StartTime.Equal(startTime) {
+		t.Errorf("expected start time %v, got %v", startTime, result.Data.StartTime)
+	}
+	if result.Data.GoroutineCount <= 0 || result.Data.GOMAXPROCS <= 0 {
+		t.Errorf("expected positive goroutine count and GOMAXPROCS, got %d and %d", result.Data.GoroutineCount, result.Data.GOMAXPROCS)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.status_flags", "query.lookback-delta, query.timeout,storage.tsdb.retention.time,storage.tsdb.retention")
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	storageMock.EXPECT().Status(gomock.Any(), "flags", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/backend_flags.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"X-Auth-Token": "someverylongtokenideed"},
+		Method:           "GET",
+		Path:             "/api/v1/status/flags",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/flags.json",
+	}.Check(t, router)
+}
+
+func TestHealthz(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, _, _ := setupTest(t, ctrl)
+
+	body := "ok\n"
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/healthz",
+		ExpectStatusCode: http.StatusOK,
+		ExpectBody:       &body,
+	}.Check(t, router)
+}
+
+func TestReadyz(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().HealthCheck().Return(nil)
+	storageMock.EXPECT().HealthCheck().Return(nil)
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/readyz",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/readyz.json",
+	}.Check(t, router)
+}
+
+func TestReadyz_cached(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	viper.Set("maia.readiness_check_interval", "1m")
+	defer viper.Set("maia.readiness_check_interval", "")
+
+	// the second probe reuses the results of the first one
+	keystoneMock.EXPECT().HealthCheck().Return(nil).Times(1)
+	storageMock.EXPECT().HealthCheck().Return(errors.New("testerror")).Times(1)
+
+	for i := 0; i < 2; i++ {
+		test.APIRequest{
+			Method:           "GET",
+			Path:             "/readyz",
+			ExpectStatusCode: http.StatusServiceUnavailable,
+			ExpectJSON:       "fixtures/readyz_storage_down.json",
+		}.Check(t, router)
+	}
+}
+
+func TestReadyz_storageDown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().HealthCheck().Return(nil)
+	storageMock.EXPECT().HealthCheck().Return(errors.New("testerror"))
+
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/readyz",
+		ExpectStatusCode: http.StatusServiceUnavailable,
+		ExpectJSON:       "fixtures/readyz_storage_down.json",
+	}.Check(t, router)
+}
+
+func TestQuery_requestID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	var backendRequestID string
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Do(
+		func(ctx context.Context, query, time, timeout, acceptContentType string) {
+			backendRequestID = util.RequestIDFromContext(ctx)
+		}).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	request := httptest.NewRequest("GET", "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m", nil)
+	request.Header.Set("Authorization", base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")))
+	request.Header.Set("Accept", storage.JSON)
+	request.Header.Set(util.RequestIDHeader, "test-request-4711")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if id := recorder.Header().Get(util.RequestIDHeader); id != "test-request-4711" {
+		t.Errorf("expected request ID test-request-4711 in response, got %s", id)
+	}
+	if backendRequestID != "test-request-4711" {
+		t.Errorf("expected request ID test-request-4711 to be passed to the backend, got %s", backendRequestID)
+	}
+}
+
+func TestQuery_traceContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	if _, err := tracing.Init(); err != nil {
+		t.Fatal(err)
+	}
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+
+	var backendTraceID string
+	expectAuthByProjectID(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Do(
+		func(ctx context.Context, query, time, timeout, acceptContentType string) {
+			backendTraceID = trace.SpanContextFromContext(ctx).TraceID().String()
+		}).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	request := httptest.NewRequest("GET", "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m", nil)
+	request.Header.Set("Authorization", base64.StdEncoding.EncodeToString([]byte("Basic user_id|12345:password")))
+	request.Header.Set("Accept", storage.JSON)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if backendTraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected trace 4bf92f3577b34da6a3ce929d0e0e4736 to be continued towards the backend, got %s", backendTraceID)
+	}
+}
+
+func TestQuery_tenantMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	viper.Set("maia.tenant_metrics", true)
+	viper.Set("maia.tenant_metrics_projects", "12345")
+	viper.Set("maia.tenant_metrics_domains", "77777")
+	defer viper.Set("maia.tenant_metrics", false)
+	router, keystoneMock, storageMock := setupTest(t, ctrl)
+	// the counters are shared, so setting up the metrics again must not register them twice
+	if newUsageMetrics() == nil {
+		t.Fatal("tenant metrics should be enabled")
+	}
+
+	header := map[string]string{"X-Project-Domain-Id": projectContext.Auth["project_domain_id"]}
+	for k, v := range projectHeader {
+		header[k] = v
+	}
+	authCall := keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: header}, false).Return(projectContext, nil)
+	keystoneMock.EXPECT().ChildProjects(gomock.Any(), "12345").Return([]string{}, nil).After(authCall)
+	storageMock.EXPECT().Query(gomock.Any(), "sum(blackbox_api_status_gauge{check=~\"keystone\",project_id=\"12345\"})", "2017-07-01T20:10:30.781Z", "24m", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+
+	test.APIRequest{
+		Headers:          map[string]string{"Accept": storage.JSON},
+		Method:           "GET",
+		Path:             "/api/v1/query?query=sum(blackbox_api_status_gauge{check%3D~%22keystone%22})&time=2017-07-01T20:10:30.781Z&timeout=24m",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/query.json",
+	}.Check(t, router)
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "maia_tenant_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["domain"] != "77777" || labels["project"] != "12345" || !strings.HasSuffix(labels["handler"], "/query") {
+				t.Errorf("unexpected labels of %s: %v", mf.GetName(), labels)
+			}
+			found[mf.GetName()] = true
+			if mf.GetName() == "maia_tenant_requests_count" && m.GetCounter().GetValue() != 1 {
+				t.Errorf("expected 1 request, got %f", m.GetCounter().GetValue())
+			}
+		}
+	}
+	for _, name := range []string{"maia_tenant_requests_count", "maia_tenant_response_bytes_count", "maia_tenant_backend_seconds_total"} {
+		if !found[name] {
+			t.Errorf("metric %s not recorded", name)
+		}
+	}
+}
+
+func TestUsageMetrics_scopeLabels(t *testing.T) {
+	m := &usageMetrics{domains: parseAllowlist("d1, d2"), projects: parseAllowlist("p1")}
+	for _, tc := range []struct {
+		header          map[string]string
+		domain, project string
+	}{
+		{map[string]string{"X-Project-Id": "p1", "X-Project-Domain-Id": "d1"}, "d1", "p1"},
+		{map[string]string{"X-Project-Id": "p2", "X-Project-Domain-Id": "d2"}, "d2", "other"},
+		{map[string]string{"X-Project-Id": "p1", "X-Project-Domain-Id": "d3"}, "other", "p1"},
+		{map[string]string{"X-Domain-Id": "d1"}, "d1", ""},
+		{map[string]string{"X-Domain-Id": "d3"}, "other", ""},
+	} {
+		h := http.Header{}
+		for k, v := range tc.header {
+			h.Set(k, v)
+		}
+		if domain, project := m.scopeLabels(h); domain != tc.domain || project != tc.project {
+			t.Errorf("%v: expected domain %q and project %q, got %q and %q", tc.header, tc.domain, tc.project, domain, project)
+		}
+	}
+}
+
+func TestUsageMetrics_scopeLabelsEmptyAllowlist(t *testing.T) {
+	// like projects, domains are counted as "other" unless listed
+	m := &usageMetrics{}
+	h := http.Header{}
+	h.Set("X-Project-Id", "p1")
+	h.Set("X-Project-Domain-Id", "d1")
+	if domain, project := m.scopeLabels(h); domain != otherScope || project != otherScope {
+		t.Errorf("expected domain and project %q, got %q and %q", otherScope, domain, project)
+	}
+}
+
+func TestMetricNameFilter_roles(t *testing.T) {
+	viper.Set("metric_visibility.monitoring_viewer.deny", "billing_.*,capacity_.*")
+	viper.Set("metric_visibility.billing_viewer.allow", "billing_.*")
+	defer viper.Set("metric_visibility", nil)
+
+	// roles without configuration do not restrict anything
+	if filter, err := metricNameFilter([]string{"member", "monitoring_admin"}); err != nil || filter != nil {
+		t.Errorf("Expected no filter for unconfigured roles, got %v (%v)", filter, err)
+	}
+
+	filter, err := metricNameFilter([]string{"member", "monitoring_viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Visible("up") || filter.Visible("billing_invoices") || filter.Visible("capacity_cores") {
+		t.Error("Unexpected visibility for role monitoring_viewer")
+	}
+
+	filter, err = metricNameFilter([]string{"billing_viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Visible("up") || !filter.Visible("billing_invoices") {
+		t.Error("Unexpected visibility for role billing_viewer")
+	}
+
+	// allow lists are combined, deny lists always apply
+	filter, err = metricNameFilter([]string{"monitoring_viewer", "billing_viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Visible("up") || filter.Visible("billing_invoices") || filter.Visible("capacity_cores") {
+		t.Error("Unexpected visibility for roles monitoring_viewer and billing_viewer")
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	keystoneMock.EXPECT().FlushCache("u00001", "")
+
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/api/v1/admin/cache/flush?user_id=u00001",
+		ExpectStatusCode: http.StatusNoContent,
+	}.Check(t, router)
+}
+
+func TestFlushCache_project(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	// project_id is the scope of the admin, not the project to flush
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+	keystoneMock.EXPECT().FlushCache("", "p00002")
+
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/api/v1/admin/cache/flush?project_id=p00001&flush_project_id=p00002",
+		ExpectStatusCode: http.StatusNoContent,
+	}.Check(t, router)
+}
+
+func TestFlushCache_missingParameter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	router, keystoneMock, _ := setupTest(t, ctrl)
+
+	keystoneMock.EXPECT().AuthenticateRequest(test.HTTPRequestMatcher{InjectHeader: projectHeader}, false).Return(projectContext, nil)
+
+	test.APIRequest{
+		Method:           "POST",
+		Path:             "/api/v1/admin/cache/flush",
+		ExpectStatusCode: http.StatusBadRequest,
 	}.Check(t, router)
 }
@@ -0,0 +1,98 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sapcc/maia/pkg/audit"
+)
+
+// auditor is nil when auditing is disabled
+var auditor *audit.Auditor
+
+// auditRecord collects the details of a data access while the request is processed
+type auditRecord struct {
+	childProjects    []string
+	rewrittenQueries []string
+	showAll          bool
+}
+
+// auditAccess records an audit event for every (authorized) data-access request
+func auditAccess(handlerFunc http.HandlerFunc, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auditor == nil {
+			handlerFunc(w, req)
+			return
+		}
+
+		rec := &auditRecord{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handlerFunc(recorder, req.WithContext(context.WithValue(req.Context(), auditRecordKey, rec)))
+
+		queryParams := req.URL.Query()
+		queries := queryParams["match[]"]
+		if q := queryParams.Get("query"); q != "" {
+			queries = append(queries, q)
+		}
+		h := req.Header
+		auditor.Record(audit.NewEvent(audit.DataAccess{
+			Action:           action,
+			RequestPath:      req.URL.Path,
+			ClientAddress:    req.RemoteAddr,
+			UserAgent:        req.UserAgent(),
+			UserID:           h.Get("X-User-Id"),
+			UserName:         h.Get("X-User-Name"),
+			UserDomainName:   h.Get("X-User-Domain-Name"),
+			ProjectID:        h.Get("X-Project-Id"),
+			ProjectName:      h.Get("X-Project-Name"),
+			DomainID:         h.Get("X-Domain-Id"),
+			DomainName:       h.Get("X-Domain-Name"),
+			ChildProjects:    rec.childProjects,
+			Queries:          queries,
+			RewrittenQueries: rec.rewrittenQueries,
+			Unrestricted:     rec.showAll,
+			StatusCode:       recorder.status,
+			ResponseSize:     recorder.size,
+		}))
+	}
+}
+
+// recordChildProjects remembers the child projects included in the label constraint for auditing
+func recordChildProjects(req *http.Request, children []string) {
+	if rec, ok := req.Context().Value(auditRecordKey).(*auditRecord); ok {
+		rec.childProjects = children
+	}
+}
+
+// recordShowAll remembers that the queries have not been restricted to the scope
+func recordShowAll(req *http.Request) {
+	if rec, ok := req.Context().Value(auditRecordKey).(*auditRecord); ok {
+		rec.showAll = true
+	}
+}
+
+// recordRewrite remembers the rewritten expressions/selectors for auditing
+func recordRewrite(req *http.Request, queries ...string) {
+	if rec, ok := req.Context().Value(auditRecordKey).(*auditRecord); ok {
+		rec.rewrittenQueries = append(rec.rewrittenQueries, queries...)
+	}
+}
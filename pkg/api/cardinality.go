@@ -0,0 +1,231 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/sapcc/maia/pkg/storage"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// Cardinality reports the metric names with the most series and the labels with the most distinct values within the
+// scope of the request. It is computed from the series API (like LabelValues), so the result is cached for
+// maia.cardinality_cache_ttl and scopes with more than maia.cardinality_max_series series are rejected.
+func (p *v1Provider) Cardinality(w http.ResponseWriter, req *http.Request) {
+	limit, err := cardinalityLimit(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusBadRequest)
+		return
+	}
+	// do not count series older than maia.label_value_ttl
+	ttl, err := time.ParseDuration(viper.GetString("maia.label_value_ttl"))
+	if err != nil {
+		ReturnPromError(w, errors.New("Invalid Maia configuration (maia.label_value_ttl)"), http.StatusInternalServerError)
+		return
+	}
+
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
+	selectors, err := rewriteSelector(req, "{__name__!=\"\"}", constraints)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the selectors contain the scope and the visible metrics, so they identify the result
+	key := "cardinality/" + strings.Join(selectors, ",")
+	var data storage.CardinalityData
+	if cached, found := p.cardinalityCache.Get(key); !found || json.Unmarshal(cached, &data) != nil {
+		start := time.Now().Add(-ttl)
+		end := time.Now()
+		resp, err := p.storage.Series(req.Context(), selectors, start.Format(time.RFC3339), end.Format(time.RFC3339), storage.JSON)
+		if err != nil {
+			ReturnPromError(w, err, http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			ReturnResponse(w, resp)
+			return
+		}
+		maxSeries := viper.GetInt("maia.cardinality_max_series")
+		series, err := decodeSeriesData(resp, maxSeries)
+		if _, ok := err.(seriesLimitError); ok {
+			ReturnPromError(w, fmt.Errorf("the scope contains more than %d series, which is too many to count", maxSeries), http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			ReturnPromError(w, err, http.StatusBadGateway)
+			return
+		}
+
+		data = countCardinality(series, rules, requestMetricNameFilter(req))
+		if cacheTTL := viper.GetDuration("maia.cardinality_cache_ttl"); cacheTTL > 0 {
+			if buf, err := json.Marshal(&data); err == nil {
+				p.cardinalityCache.Set(key, buf, cacheTTL)
+			}
+		}
+	}
+
+	if limit > 0 && len(data.SeriesCountByMetricName) > limit {
+		data.SeriesCountByMetricName = data.SeriesCountByMetricName[:limit]
+	}
+	if limit > 0 && len(data.LabelValueCountByLabelName) > limit {
+		data.LabelValueCountByLabelName = data.LabelValueCountByLabelName[:limit]
+	}
+	ReturnJSON(w, http.StatusOK, &storage.CardinalityResponse{Status: storage.StatusSuccess, Data: data})
+}
+
+// decodeSeriesData reads the series of a series API response. Series are counted while reading, so that decoding
+// stops as soon as there are more than maxSeries series (0 = unlimited) instead of holding all of them in memory.
+func decodeSeriesData(resp *http.Response, maxSeries int) ([]model.LabelSet, error) {
+	defer resp.Body.Close()
+
+	series := []model.LabelSet{}
+	decoder := json.NewDecoder(resp.Body)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "data" {
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectDelim(decoder, '['); err != nil {
+			return nil, err
+		}
+		for decoder.More() {
+			if maxSeries > 0 && len(series) >= maxSeries {
+				return nil, seriesLimitError{maxSeries}
+			}
+			var ls model.LabelSet
+			if err := decoder.Decode(&ls); err != nil {
+				return nil, err
+			}
+			series = append(series, ls)
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+// expectDelim reads the next JSON token, which has to be the given delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("malformed series response: expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+// cardinalityLimit determines the number of entries per list from the limit parameter (default:
+// maia.cardinality_limit, at most maia.cardinality_max_limit). 0 means unlimited.
+func cardinalityLimit(req *http.Request) (int, error) {
+	limit := viper.GetInt("maia.cardinality_limit")
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+	if maxLimit := viper.GetInt("maia.cardinality_max_limit"); maxLimit > 0 && limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
+
+// countCardinality counts the series per metric name and the distinct values per label name. The label rules are
+// applied first, so that redacted labels are not disclosed and series which only differed in them are counted once.
+func countCardinality(series []model.LabelSet, rules *labelRules, filter *util.MetricNameFilter) storage.CardinalityData {
+	seen := map[model.Fingerprint]bool{}
+	seriesCount := map[string]int{}
+	labelValues := map[string]map[model.LabelValue]bool{}
+	for _, lset := range series {
+		if rules != nil {
+			lset = rules.applyToLabelSet(lset)
+		}
+		name := string(lset[model.MetricNameLabel])
+		fp := lset.Fingerprint()
+		if seen[fp] || (filter != nil && !filter.Visible(name)) {
+			continue
+		}
+		seen[fp] = true
+		seriesCount[name]++
+		for k, v := range lset {
+			if labelValues[string(k)] == nil {
+				labelValues[string(k)] = map[model.LabelValue]bool{}
+			}
+			labelValues[string(k)][v] = true
+		}
+	}
+
+	labelCount := make(map[string]int, len(labelValues))
+	for k, values := range labelValues {
+		labelCount[k] = len(values)
+	}
+	return storage.CardinalityData{
+		TotalSeries:                len(seen),
+		SeriesCountByMetricName:    sortedCardinality(seriesCount),
+		LabelValueCountByLabelName: sortedCardinality(labelCount),
+	}
+}
+
+// sortedCardinality turns counts into a list with the highest count first
+func sortedCardinality(counts map[string]int) []storage.CardinalityEntry {
+	result := make([]storage.CardinalityEntry, 0, len(counts))
+	for name, value := range counts {
+		result = append(result, storage.CardinalityEntry{Name: name, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Value != result[j].Value {
+			return result[i].Value > result[j].Value
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
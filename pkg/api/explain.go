@@ -0,0 +1,76 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sapcc/maia/pkg/storage"
+	"github.com/sapcc/maia/pkg/util"
+)
+
+// Explain rewrites a query like the query APIs do, but returns the rewritten query together with the scope instead of
+// executing it. This helps users to understand why a query does not return the expected series.
+func (p *v1Provider) Explain(w http.ResponseWriter, req *http.Request) {
+	// the audit record collects the details of the rewriting (it is only present if auditing is enabled)
+	rec, ok := req.Context().Value(auditRecordKey).(*auditRecord)
+	if !ok {
+		rec = &auditRecord{}
+		req = req.WithContext(context.WithValue(req.Context(), auditRecordKey, rec))
+	}
+
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+
+	query := req.URL.Query().Get("query")
+	newQuery, err := rewriteExpression(req, query, constraints)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusBadRequest)
+		return
+	}
+	findings, err := util.AnalyzeExpressionCost(query)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	scope := storage.ExplainScope{
+		ProjectID:     req.Header.Get("X-Project-Id"),
+		DomainID:      req.Header.Get("X-Domain-Id"),
+		ChildProjects: rec.childProjects,
+		Labels:        map[string][]string{},
+		ShowAll:       rec.showAll,
+	}
+	if scope.ChildProjects == nil {
+		scope.ChildProjects = []string{}
+	}
+	for _, c := range constraints {
+		scope.Labels[c.Key] = c.Values
+	}
+
+	ReturnJSON(w, http.StatusOK, &storage.ExplainResponse{
+		Status: storage.StatusSuccess,
+		Data:   storage.ExplainData{Query: query, RewrittenQuery: newQuery, Scope: scope, Findings: findings},
+	})
+}
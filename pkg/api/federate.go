@@ -0,0 +1,266 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// returnFederateResponse processes the metric families returned by the federate API of the backend (protobuf or text
+// format): it applies the label rules, adds the external labels (maia.federate_external_labels) and enforces the
+// series limit (maia.federate_max_series). The result is encoded in the format requested by the client.
+func returnFederateResponse(w http.ResponseWriter, req *http.Request, resp *http.Response, rules *labelRules) {
+	if resp.StatusCode != http.StatusOK {
+		ReturnResponse(w, resp)
+		return
+	}
+	defer resp.Body.Close()
+
+	externalLabels, err := parseExternalLabels()
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	families, err := decodeMetricFamilies(resp, viper.GetInt("maia.federate_max_series"))
+	if _, ok := err.(seriesLimitError); ok {
+		ReturnPromError(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		ReturnPromError(w, err, http.StatusBadGateway)
+		return
+	}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			if rules != nil {
+				m.Label = rules.applyToLabelPairs(m.Label)
+			}
+			m.Label = addExternalLabels(m.Label, externalLabels)
+		}
+	}
+
+	format := expfmt.NegotiateIncludingOpenMetrics(req.Header)
+	w.Header().Set("Content-Type", string(format))
+	w.WriteHeader(http.StatusOK)
+	encoder := expfmt.NewEncoder(w, format)
+	for _, mf := range families {
+		if err := encoder.Encode(mf); err != nil {
+			// too late to report the error to the client
+			util.LogWarning("Could not encode federate response: %v", err)
+			return
+		}
+	}
+	// OpenMetrics requires a terminating "# EOF" line
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			util.LogWarning("Could not encode federate response: %v", err)
+		}
+	}
+}
+
+// seriesLimitError is returned if federation would return more series than permitted
+type seriesLimitError struct {
+	limit int
+}
+
+func (e seriesLimitError) Error() string {
+	return fmt.Sprintf("federation would return more than %d series, please use more specific selectors", e.limit)
+}
+
+// decodeMetricFamilies reads the metric families of a federate response. Series are counted while reading, so that
+// decoding stops as soon as there are more than maxSeries series (0 = unlimited) instead of buffering the whole
+// response first.
+func decodeMetricFamilies(resp *http.Response, maxSeries int) ([]*dto.MetricFamily, error) {
+	format := expfmt.ResponseFormat(resp.Header)
+	if format == expfmt.FmtUnknown {
+		// never pass on data that could not be processed
+		return nil, fmt.Errorf("unsupported federate response format: %s", resp.Header.Get("Content-Type"))
+	}
+
+	if format == expfmt.FmtProtoDelim {
+		return decodeProtobufFamilies(bufio.NewReader(resp.Body), maxSeries)
+	}
+
+	// the text parser reads the whole input before returning the first family, so check the limit beforehand
+	body := io.Reader(resp.Body)
+	if maxSeries > 0 {
+		var err error
+		if body, err = limitTextSeries(resp.Body, maxSeries); err != nil {
+			return nil, err
+		}
+	}
+	var families []*dto.MetricFamily
+	decoder := expfmt.NewDecoder(body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+// limitTextSeries buffers a response in the text format up to maxSeries sample lines.
+func limitTextSeries(r io.Reader, maxSeries int) (io.Reader, error) {
+	var buf bytes.Buffer
+	series := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] != '#' {
+			series++
+			if series > maxSeries {
+				return nil, seriesLimitError{maxSeries}
+			}
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return &buf, scanner.Err()
+}
+
+// maxLineLength is the longest line accepted in text federate responses
+const maxLineLength = 1024 * 1024
+
+// decodeProtobufFamilies reads length-delimited metric families. Each family is processed field by field so that
+// metrics are counted (and decoded) one at a time rather than after reading a complete, possibly huge family.
+func decodeProtobufFamilies(r *bufio.Reader, maxSeries int) ([]*dto.MetricFamily, error) {
+	var families []*dto.MetricFamily
+	series := 0
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		mf := &dto.MetricFamily{}
+		var metrics []*dto.Metric
+		// all fields other than the metrics, e.g. name, help and type
+		var header []byte
+		fields := bufio.NewReader(io.LimitReader(r, int64(size)))
+		for {
+			tag, err := binary.ReadUvarint(fields)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			num, typ := protowire.DecodeTag(tag)
+			switch typ {
+			case protowire.VarintType:
+				v, err := binary.ReadUvarint(fields)
+				if err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				header = protowire.AppendVarint(protowire.AppendTag(header, num, typ), v)
+			case protowire.BytesType:
+				length, err := binary.ReadUvarint(fields)
+				if err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				if length > size {
+					return nil, fmt.Errorf("invalid field length %d in metric family", length)
+				}
+				data := make([]byte, length)
+				if _, err := io.ReadFull(fields, data); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				if num != metricFieldNumber {
+					header = protowire.AppendBytes(protowire.AppendTag(header, num, typ), data)
+					continue
+				}
+				series++
+				if maxSeries > 0 && series > maxSeries {
+					return nil, seriesLimitError{maxSeries}
+				}
+				m := &dto.Metric{}
+				if err := proto.Unmarshal(data, m); err != nil {
+					return nil, err
+				}
+				metrics = append(metrics, m)
+			default:
+				return nil, fmt.Errorf("unexpected wire type %d in metric family", typ)
+			}
+		}
+		if err := proto.Unmarshal(header, mf); err != nil {
+			return nil, err
+		}
+		mf.Metric = metrics
+		families = append(families, mf)
+	}
+}
+
+// metricFieldNumber is the protobuf field number of MetricFamily.metric
+const metricFieldNumber = 4
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseExternalLabels reads the labels added to all federated series, sorted by name
+func parseExternalLabels() ([]*dto.LabelPair, error) {
+	pairs, err := parseLabelPairs("maia.federate_external_labels")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*dto.LabelPair, 0, len(pairs))
+	for name, value := range pairs {
+		name, value := string(name), value
+		result = append(result, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, nil
+}
+
+// addExternalLabels appends the external labels to those of a metric. Like in Prometheus, labels of the metric take
+// precedence.
+func addExternalLabels(pairs []*dto.LabelPair, externalLabels []*dto.LabelPair) []*dto.LabelPair {
+	for _, external := range externalLabels {
+		exists := false
+		for _, pair := range pairs {
+			exists = exists || pair.GetName() == external.GetName()
+		}
+		if !exists {
+			pairs = append(pairs, external)
+		}
+	}
+	return pairs
+}
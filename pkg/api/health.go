@@ -0,0 +1,116 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+const (
+	checkStatusOK    = "ok"
+	checkStatusError = "error"
+)
+
+// checkResult describes the state of a single dependency
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessReport is the response of /readyz
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthz is the liveness probe: as long as the process is able to serve HTTP requests, it is alive
+func healthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "ok\n")
+}
+
+// dependencyChecks holds the results of the last readiness checks, so that frequent probes do not put load on
+// Keystone and Prometheus (maia.readiness_check_interval)
+var dependencyChecks struct {
+	sync.Mutex
+	checkedAt time.Time
+	results   map[string]checkResult
+}
+
+// readyz is the readiness probe: Maia is only ready to serve requests when all of its dependencies are
+func readyz(w http.ResponseWriter, req *http.Request) {
+	report := readinessReport{Status: checkStatusOK, Checks: checkDependencies()}
+
+	code := http.StatusOK
+	for name, result := range report.Checks {
+		if result.Status != checkStatusOK {
+			util.LogWarning("Readiness check %s failed: %s", name, result.Error)
+			report.Status = checkStatusError
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	ReturnJSON(w, code, report)
+}
+
+// checkDependencies checks the dependencies unless the last results are recent enough. Concurrent probes wait for the
+// same checks instead of running their own.
+func checkDependencies() map[string]checkResult {
+	dependencyChecks.Lock()
+	defer dependencyChecks.Unlock()
+
+	if dependencyChecks.results != nil && time.Since(dependencyChecks.checkedAt) < viper.GetDuration("maia.readiness_check_interval") {
+		return dependencyChecks.results
+	}
+	dependencyChecks.results = map[string]checkResult{
+		"keystone": toCheckResult(keystoneInstance.HealthCheck()),
+		"storage":  toCheckResult(storageInstance.HealthCheck()),
+		"policy":   toCheckResult(checkPolicy()),
+	}
+	dependencyChecks.checkedAt = time.Now()
+	return dependencyChecks.results
+}
+
+// resetDependencyChecks discards the cached results, e.g. when the dependencies are replaced
+func resetDependencyChecks() {
+	dependencyChecks.Lock()
+	defer dependencyChecks.Unlock()
+	dependencyChecks.results = nil
+}
+
+// checkPolicy makes sure that the policy file can be loaded
+func checkPolicy() error {
+	_, err := initPolicyEngine()
+	return err
+}
+
+func toCheckResult(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: checkStatusError, Error: err.Error()}
+	}
+	return checkResult{Status: checkStatusOK}
+}
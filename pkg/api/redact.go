@@ -0,0 +1,266 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/sapcc/maia/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+// labelRules describes how labels of series are redacted and renamed before they are returned to tenants
+// (maia.redact_labels, maia.rename_labels)
+type labelRules struct {
+	redact map[model.LabelName]bool
+	rename map[model.LabelName]model.LabelName
+}
+
+// responseLabelRules returns the label rules applicable to the responses of a request. It returns nil if the labels
+// are passed on unchanged, i.e. if no rules are configured or the user may see all tenants anyway.
+func responseLabelRules(req *http.Request) (*labelRules, error) {
+	if isShowAll(req) {
+		return nil, nil
+	}
+
+	rules := labelRules{redact: map[model.LabelName]bool{}, rename: map[model.LabelName]model.LabelName{}}
+	for _, name := range strings.Split(viper.GetString("maia.redact_labels"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rules.redact[model.LabelName(name)] = true
+		}
+	}
+	renames, err := parseLabelPairs("maia.rename_labels")
+	if err != nil {
+		return nil, err
+	}
+	for from, to := range renames {
+		if !model.LabelName(to).IsValid() {
+			return nil, fmt.Errorf("Invalid Maia configuration (maia.rename_labels): %q is not a valid label name", to)
+		}
+		rules.rename[from] = model.LabelName(to)
+	}
+
+	if len(rules.redact) == 0 && len(rules.rename) == 0 {
+		return nil, nil
+	}
+	return &rules, nil
+}
+
+// parseLabelPairs parses a comma-separated list of name=value pairs from the configuration, where the names have to
+// be valid label names
+func parseLabelPairs(key string) (map[model.LabelName]string, error) {
+	result := map[model.LabelName]string{}
+	for _, pair := range strings.Split(viper.GetString(key), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !model.LabelName(parts[0]).IsValid() {
+			return nil, fmt.Errorf("Invalid Maia configuration (%s): %q is not of the form name=value", key, pair)
+		}
+		result[model.LabelName(parts[0])] = parts[1]
+	}
+	return result, nil
+}
+
+// sourceNames lists the labels of the stored series that are returned under the given name
+func (r *labelRules) sourceNames(name model.LabelName) []model.LabelName {
+	var result []model.LabelName
+	if _, renamed := r.rename[name]; !renamed && !r.redact[name] {
+		result = append(result, name)
+	}
+	for from, to := range r.rename {
+		if to == name {
+			result = append(result, from)
+		}
+	}
+	return result
+}
+
+// targetName determines the name under which a label is returned (false if it is redacted). If the new name of a
+// renamed label is already taken, the renamed label wins.
+func (r *labelRules) targetName(name model.LabelName) (model.LabelName, bool) {
+	if to, ok := r.rename[name]; ok {
+		return to, true
+	}
+	return name, !r.redact[name]
+}
+
+// hidden tells whether the values of a label of the stored series are not returned at all
+func (r *labelRules) hidden(name string) bool {
+	_, visible := r.targetName(model.LabelName(name))
+	return !visible
+}
+
+// applyToLabelSet returns a copy of the label set with the rules applied
+func (r *labelRules) applyToLabelSet(ls model.LabelSet) model.LabelSet {
+	result := make(model.LabelSet, len(ls))
+	for name, value := range ls {
+		target, ok := r.targetName(name)
+		if !ok {
+			continue
+		}
+		if _, renamed := r.rename[name]; renamed || result[target] == "" {
+			result[target] = value
+		}
+	}
+	return result
+}
+
+// applyToLabelPairs applies the rules to the labels of a metric decoded from the exposition format
+func (r *labelRules) applyToLabelPairs(pairs []*dto.LabelPair) []*dto.LabelPair {
+	result := make([]*dto.LabelPair, 0, len(pairs))
+	index := map[model.LabelName]int{}
+	for _, pair := range pairs {
+		target, ok := r.targetName(model.LabelName(pair.GetName()))
+		if !ok {
+			continue
+		}
+		_, renamed := r.rename[model.LabelName(pair.GetName())]
+		if i, exists := index[target]; exists {
+			if renamed {
+				result[i].Value = pair.Value
+			}
+			continue
+		}
+		name := string(target)
+		index[target] = len(result)
+		result = append(result, &dto.LabelPair{Name: &name, Value: pair.Value})
+	}
+	return result
+}
+
+// applyToValue applies the rules to the series of a query result. Scalars and strings have no labels. Series which
+// only differed in redacted labels cannot be told apart afterwards, so such results are rejected (like Prometheus
+// rejects vectors with duplicate label sets).
+func (r *labelRules) applyToValue(value model.Value) error {
+	seen := map[model.Fingerprint]bool{}
+	apply := func(metric model.Metric) (model.Metric, error) {
+		metric = model.Metric(r.applyToLabelSet(model.LabelSet(metric)))
+		fp := metric.Fingerprint()
+		if seen[fp] {
+			return nil, fmt.Errorf("several series of the result have the labels %s after redaction, aggregate the redacted labels away", metric)
+		}
+		seen[fp] = true
+		return metric, nil
+	}
+
+	var err error
+	switch v := value.(type) {
+	case model.Vector:
+		for _, sample := range v {
+			if sample.Metric, err = apply(sample.Metric); err != nil {
+				return err
+			}
+		}
+	case model.Matrix:
+		for _, stream := range v {
+			if stream.Metric, err = apply(stream.Metric); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returnRedactedQueryResponse forwards the response of the query or query_range API with the label rules applied
+func returnRedactedQueryResponse(w http.ResponseWriter, resp *http.Response, rules *labelRules) {
+	if rules == nil || resp.StatusCode != http.StatusOK {
+		ReturnResponse(w, resp)
+		return
+	}
+
+	var qr storage.QueryResponse
+	if err := decodeJSONResponse(resp, &qr); err != nil {
+		ReturnPromError(w, err, http.StatusBadGateway)
+		return
+	}
+	if err := rules.applyToValue(qr.Data.Value); err != nil {
+		ReturnPromError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	qr.Data.Result = qr.Data.Value
+
+	ReturnJSON(w, http.StatusOK, &qr)
+}
+
+// returnRedactedSeriesResponse forwards the response of the series API with the label rules applied. Series which
+// only differed in redacted labels are merged.
+func returnRedactedSeriesResponse(w http.ResponseWriter, resp *http.Response, rules *labelRules) {
+	if rules == nil || resp.StatusCode != http.StatusOK {
+		ReturnResponse(w, resp)
+		return
+	}
+
+	var sr storage.SeriesResponse
+	if err := decodeJSONResponse(resp, &sr); err != nil {
+		ReturnPromError(w, err, http.StatusBadGateway)
+		return
+	}
+	seen := map[model.Fingerprint]bool{}
+	data := make([]model.LabelSet, 0, len(sr.Data))
+	for _, lset := range sr.Data {
+		lset = rules.applyToLabelSet(lset)
+		if fp := lset.Fingerprint(); !seen[fp] {
+			seen[fp] = true
+			data = append(data, lset)
+		}
+	}
+	sr.Data = data
+
+	ReturnJSON(w, http.StatusOK, &sr)
+}
+
+// returnRedactedExemplarsResponse forwards the response of the query_exemplars API with the label rules applied to
+// the series. The labels of the exemplars themselves (e.g. trace IDs) are passed on unchanged.
+func returnRedactedExemplarsResponse(w http.ResponseWriter, resp *http.Response, rules *labelRules) {
+	if rules == nil || resp.StatusCode != http.StatusOK {
+		ReturnResponse(w, resp)
+		return
+	}
+
+	var er storage.ExemplarsResponse
+	if err := decodeJSONResponse(resp, &er); err != nil {
+		ReturnPromError(w, err, http.StatusBadGateway)
+		return
+	}
+	for i := range er.Data {
+		er.Data[i].SeriesLabels = rules.applyToLabelSet(er.Data[i].SeriesLabels)
+	}
+
+	ReturnJSON(w, http.StatusOK, &er)
+}
+
+// decodeJSONResponse reads a JSON response from the backend
+func decodeJSONResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, result)
+}
@@ -20,6 +20,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 
 	"bytes"
@@ -27,19 +28,28 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"github.com/sapcc/maia/pkg/audit"
 	"github.com/sapcc/maia/pkg/keystone"
 	"github.com/sapcc/maia/pkg/storage"
+	"github.com/sapcc/maia/pkg/tracing"
 	"github.com/sapcc/maia/pkg/ui"
 	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/viper"
 	"io"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var storageInstance storage.Driver
 var keystoneInstance keystone.Driver
 
+// startTime is reported by the /status/runtimeinfo API
+var startTime = time.Now()
+
 // Server initializes and starts the API server, hooking it up to the API router
 func Server() error {
 
@@ -48,7 +58,14 @@ func Server() error {
 		panic(fmt.Errorf("Prometheus endpoint not configured (maia.prometheus_url / MAIA_PROMETHEUS_URL)"))
 	}
 
+	shutdownTracing, err := tracing.Init()
+	if err != nil {
+		panic(fmt.Errorf("Could not set up tracing: %s", err.Error()))
+	}
+	defer shutdownTracing(context.Background())
+
 	mainRouter := setupRouter(keystone.NewKeystoneDriver(), storage.NewPrometheusDriver(prometheusAPIURL, map[string]string{}))
+	auditor = audit.NewAuditor()
 
 	http.Handle("/", mainRouter)
 
@@ -62,12 +79,39 @@ func Server() error {
 	})
 	handler := c.Handler(mainRouter)
 
-	return http.ListenAndServe(bindAddress, handler)
+	// on SIGTERM/SIGINT, finish the requests in progress and deliver their audit events before exiting
+	server := &http.Server{Addr: bindAddress, Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		util.LogInfo("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("maia.shutdown_timeout"))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			util.LogError("Could not finish all requests: %v", err)
+		}
+		close(stopped)
+	}()
+
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		err = nil
+	}
+	if auditor != nil {
+		if closeErr := auditor.Close(); closeErr != nil {
+			util.LogError("Could not close the audit sink: %v", closeErr)
+		}
+	}
+	return err
 }
 
 func setupRouter(keystone keystone.Driver, storage storage.Driver) http.Handler {
 	storageInstance = storage
 	keystoneInstance = keystone
+	resetDependencyChecks()
 
 	mainRouter := mux.NewRouter()
 	mainRouter.Methods(http.MethodGet).Path("/").HandlerFunc(redirectToRootPage)
@@ -88,18 +132,21 @@ func setupRouter(keystone keystone.Driver, storage storage.Driver) http.Handler
 	// other endpoints
 	// maia's federate endpoint
 	mainRouter.Methods(http.MethodGet).Path("/federate").HandlerFunc(
-		authorize(observeDuration(Federate, "federate"), false, "metric:show"))
+		authorize(auditAccess(observeDuration(Federate, "federate"), audit.ActionRead), false, "metric:show"))
 	// expression browser
 	mainRouter.Methods(http.MethodGet).PathPrefix("/static/").HandlerFunc(serveStaticContent)
 	mainRouter.Methods(http.MethodGet).Path("/graph").HandlerFunc(redirectToRootPage)
 	// instrumentation
 	mainRouter.Handle("/metrics", promhttp.Handler())
+	// liveness and readiness probes
+	mainRouter.Methods(http.MethodGet).Path("/healthz").HandlerFunc(healthz)
+	mainRouter.Methods(http.MethodGet).Path("/readyz").HandlerFunc(readyz)
 
-	// domain-prefixed paths. Order is relevant! This implies that there must be no domain federate, static or graph :-)
+	// domain-prefixed paths. Order is relevant! This implies that there must be no domain federate, static, graph, healthz or readyz :-)
 	mainRouter.Methods(http.MethodGet).Path("/{domain}/graph").HandlerFunc(authorize(graph, true, "metric:show"))
 	mainRouter.Methods(http.MethodGet).Path("/{domain}").HandlerFunc(redirectToDomainRootPage)
 
-	return gaugeInflight(mainRouter)
+	return logRequests(traceRequests(meterUsage(newUsageMetrics(), gaugeInflight(mainRouter))))
 }
 
 func redirectToDomainRootPage(w http.ResponseWriter, r *http.Request) {
@@ -151,15 +198,21 @@ func Federate(w http.ResponseWriter, req *http.Request) {
 		ReturnPromError(w, err, http.StatusBadRequest)
 		return
 	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
 
-	response, err := storageInstance.Federate(*selectors, req.Header.Get("Accept"))
+	// Maia processes the series itself, so the most efficient format is requested regardless of the client
+	response, err := storageInstance.Federate(req.Context(), *selectors, storage.P8SProtoBuf)
 	if err != nil {
 		util.LogError("Could not get metrics for %s", selectors)
 		ReturnPromError(w, err, http.StatusServiceUnavailable)
 		return
 	}
 
-	ReturnResponse(w, response)
+	returnFederateResponse(w, req, response, rules)
 }
 
 func graph(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,132 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// otherScope is the label value of all domains/projects that are not on the allowlist
+const otherScope = "other"
+
+var tenantLabels = []string{"handler", "domain", "project"}
+var tenantRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maia_tenant_requests_count", Help: "Number of requests per tenant"}, tenantLabels)
+var tenantResponseBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maia_tenant_response_bytes_count", Help: "Number of bytes returned per tenant"}, tenantLabels)
+var tenantBackendSecondsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maia_tenant_backend_seconds_total", Help: "Time spent waiting for Prometheus per tenant"}, tenantLabels)
+var tenantErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maia_tenant_errors_count", Help: "Number of failed requests (status 4xx or 5xx) per tenant"}, tenantLabels)
+
+// the counters are registered once, since the router can be set up several times; they stay empty unless enabled
+func init() {
+	prometheus.MustRegister(tenantRequestsCounter, tenantResponseBytesCounter, tenantBackendSecondsCounter, tenantErrorsCounter)
+}
+
+// usageMetrics counts requests, response bytes, backend time and errors per tenant (domain and project)
+type usageMetrics struct {
+	requests       *prometheus.CounterVec
+	responseBytes  *prometheus.CounterVec
+	backendSeconds *prometheus.CounterVec
+	errors         *prometheus.CounterVec
+	// domains that get their own label value
+	domains map[string]bool
+	// projects that get their own label value
+	projects map[string]bool
+}
+
+// newUsageMetrics sets up the recording of the per-tenant usage metrics. It returns nil if they are disabled (maia.tenant_metrics).
+func newUsageMetrics() *usageMetrics {
+	if !viper.GetBool("maia.tenant_metrics") {
+		return nil
+	}
+
+	return &usageMetrics{
+		requests:       tenantRequestsCounter,
+		responseBytes:  tenantResponseBytesCounter,
+		backendSeconds: tenantBackendSecondsCounter,
+		errors:         tenantErrorsCounter,
+		domains:        parseAllowlist(viper.GetString("maia.tenant_metrics_domains")),
+		projects:       parseAllowlist(viper.GetString("maia.tenant_metrics_projects")),
+	}
+}
+
+// parseAllowlist turns a comma-separated list of IDs into a set (nil if the list is empty)
+func parseAllowlist(list string) map[string]bool {
+	var result map[string]bool
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			if result == nil {
+				result = map[string]bool{}
+			}
+			result[id] = true
+		}
+	}
+	return result
+}
+
+// scopeLabels determines the domain and project label values from the scope of the authorized request
+func (m *usageMetrics) scopeLabels(h http.Header) (domain, project string) {
+	domain = h.Get("X-Domain-Id")
+	if projectID := h.Get("X-Project-Id"); projectID != "" {
+		domain = h.Get("X-Project-Domain-Id")
+		project = otherScope
+		if m.projects[projectID] {
+			project = projectID
+		}
+	}
+	if !m.domains[domain] {
+		domain = otherScope
+	}
+	return domain, project
+}
+
+// meterUsage records the usage metrics of authorized requests
+func meterUsage(m *usageMetrics, handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, timer := util.WithBackendTimer(req.Context())
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req.WithContext(ctx))
+
+		// unauthorized requests cannot be attributed to a tenant (and might carry forged scope headers)
+		info, ok := ctx.Value(requestInfoKey).(*requestInfo)
+		if !ok || !info.authorized {
+			return
+		}
+		domain, project := m.scopeLabels(req.Header)
+		labels := prometheus.Labels{"handler": info.handler, "domain": domain, "project": project}
+		m.requests.With(labels).Inc()
+		m.responseBytes.With(labels).Add(float64(recorder.size))
+		m.backendSeconds.With(labels).Add(timer.Elapsed().Seconds())
+		if recorder.status >= 400 {
+			m.errors.With(labels).Inc()
+		}
+	})
+}
@@ -21,6 +21,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,12 +31,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/maia/pkg/keystone"
 	"github.com/sapcc/maia/pkg/storage"
+	"github.com/sapcc/maia/pkg/tracing"
 	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -61,6 +66,9 @@ const authTokenHeader = "X-Auth-Token"
 const authTokenExpiryHeader = "X-Auth-Token-Expiry"
 
 var policyEnforcer *policy.Enforcer
+
+// policyMutex guards the lazy initialization of policyEnforcer, which happens on request goroutines
+var policyMutex sync.Mutex
 var authErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "maia_logon_errors_count", Help: "Number of logon errors occured in Maia"})
 var authFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -124,13 +132,19 @@ func ReturnJSON(w http.ResponseWriter, code int, data interface{}) {
 
 //ReturnPromError produces a Prometheus error Response with HTTP Status code
 func ReturnPromError(w http.ResponseWriter, err error, code int) {
+	if ne, ok := err.(net.Error); err == storage.ErrCircuitOpen || (ok && ne.Timeout()) {
+		// the backend is down or too slow
+		code = http.StatusServiceUnavailable
+	} else if _, ok := err.(scopeError); ok {
+		code = http.StatusForbidden
+	}
 	if code >= 500 {
 		promErrorsCounter.Add(1)
 	}
 
 	var errorType storage.ErrorType
 	switch code {
-	case http.StatusBadRequest:
+	case http.StatusBadRequest, http.StatusForbidden:
 		errorType = storage.ErrorBadData
 	case http.StatusUnprocessableEntity:
 		errorType = storage.ErrorExec
@@ -144,24 +158,100 @@ func ReturnPromError(w http.ResponseWriter, err error, code int) {
 	ReturnJSON(w, code, jsonErr)
 }
 
-func scopeToLabelConstraint(req *http.Request, keystone keystone.Driver) (string, []string) {
+// scopeError is returned if a request asks for data outside of the user's authorization
+type scopeError struct {
+	msg string
+}
+
+func (e scopeError) Error() string {
+	return e.msg
+}
+
+func scopeToLabelConstraints(req *http.Request, keystone keystone.Driver) ([]util.LabelConstraint, error) {
+	if isShowAll(req) {
+		recordShowAll(req)
+		return nil, nil
+	}
+	if projectIDs := req.URL.Query()["project_id"]; len(projectIDs) > 1 && viper.GetBool("maia.multi_project_queries") {
+		return multiProjectConstraints(req, keystone, projectIDs)
+	}
 	if projectID := req.Header.Get("X-Project-Id"); projectID != "" {
-		children, err := keystone.ChildProjects(projectID)
+		children, err := childProjects(req, keystone, projectID)
 		if err != nil {
 			panic(err)
 		}
-		return "project_id", append([]string{projectID}, children...)
+		recordChildProjects(req, children)
+		return []util.LabelConstraint{{Key: "project_id", Values: append([]string{projectID}, children...)}}, nil
 	} else if domainID := req.Header.Get("X-Domain-Id"); domainID != "" {
-		return "domain_id", []string{domainID}
+		constraints := []util.LabelConstraint{{Key: "domain_id", Values: []string{domainID}}}
+		// include metrics that are labeled with the project only
+		if viper.GetBool("maia.domain_scope_includes_projects") {
+			ctx, span := tracing.StartSpan(req.Context(), "keystone.child_projects", attribute.String("maia.domain_id", domainID))
+			projects, err := keystone.DomainProjects(ctx, domainID)
+			tracing.EndSpan(span, err)
+			if err != nil {
+				panic(err)
+			}
+			if len(projects) > 0 {
+				constraints = append(constraints, util.LabelConstraint{Key: "project_id", Values: projects})
+			}
+		}
+		return constraints, nil
 	}
 
 	panic(fmt.Errorf("Missing OpenStack scope attributes in request header"))
 }
 
+// childProjects looks up the subprojects of a project in a span of its own, since a cold project tree can take a while
+func childProjects(req *http.Request, keystone keystone.Driver, projectID string) ([]string, error) {
+	ctx, span := tracing.StartSpan(req.Context(), "keystone.child_projects", attribute.String("maia.project_id", projectID))
+	children, err := keystone.ChildProjects(ctx, projectID)
+	tracing.EndSpan(span, err)
+	return children, err
+}
+
+// multiProjectConstraints restricts the request to several projects (and their subprojects). The user needs to have a
+// monitoring role on each of them.
+func multiProjectConstraints(req *http.Request, keystone keystone.Driver, projectIDs []string) ([]util.LabelConstraint, error) {
+	scopes, err := keystone.UserProjects(req.Context(), req.Header.Get("X-User-Id"))
+	if err != nil {
+		panic(err)
+	}
+	permitted := map[string]bool{}
+	for _, scope := range scopes {
+		if scope.ProjectID != "" {
+			permitted[scope.ProjectID] = true
+		}
+	}
+
+	included := map[string]bool{}
+	values := []string{}
+	for _, projectID := range projectIDs {
+		if !permitted[projectID] {
+			return nil, scopeError{fmt.Sprintf("User %s does not have monitoring permissions on project %s", req.Header.Get("X-User-Name"), projectID)}
+		}
+		children, err := childProjects(req, keystone, projectID)
+		if err != nil {
+			panic(err)
+		}
+		for _, id := range append([]string{projectID}, children...) {
+			if !included[id] {
+				included[id] = true
+				values = append(values, id)
+			}
+		}
+	}
+	recordChildProjects(req, values)
+	return []util.LabelConstraint{{Key: "project_id", Values: values}}, nil
+}
+
 // buildSelectors takes the selectors contained in the "match[]" URL query parameter(s)
 // and extends them with a label-constrained for the project/domain scope
 func buildSelectors(req *http.Request, keystone keystone.Driver) (*[]string, error) {
-	labelKey, labelValues := scopeToLabelConstraint(req, keystone)
+	constraints, err := scopeToLabelConstraints(req, keystone)
+	if err != nil {
+		return nil, err
+	}
 
 	queryParams := req.URL.Query()
 	selectors := queryParams["match[]"]
@@ -170,38 +260,119 @@ func buildSelectors(req *http.Request, keystone keystone.Driver) (*[]string, err
 		return nil, errors.New("no match[] parameter provided")
 	}
 	// enrich all match statements
-	for i, sel := range selectors {
-		newSel, err := util.AddLabelConstraintToSelector(sel, labelKey, labelValues)
+	newSelectors := make([]string, 0, len(selectors)*len(constraints))
+	for _, sel := range selectors {
+		newSels, err := rewriteSelector(req, sel, constraints)
 		if err != nil {
 			return nil, err
 		}
-		selectors[i] = newSel
+		newSelectors = append(newSelectors, newSels...)
 	}
 
-	return &selectors, nil
+	return &newSelectors, nil
+}
+
+// rewriteExpression adds the label constraints for the project/domain scope to a PromQL expression. It is also
+// restricted to the metrics visible with the user's roles.
+func rewriteExpression(req *http.Request, expression string, constraints []util.LabelConstraint) (string, error) {
+	_, span := tracing.StartSpan(req.Context(), "promql.rewrite", constraintAttributes(constraints)...)
+	// redacted labels must not reappear under another name
+	rules, err := responseLabelRules(req)
+	if err == nil && rules != nil {
+		err = util.CheckLabelsNotCopied(expression, rules.hidden)
+	}
+	newExpression := expression
+	if filter := requestMetricNameFilter(req); filter != nil && err == nil {
+		newExpression, err = util.AddMetricNameFilterToExpression(expression, filter)
+	}
+	if err == nil {
+		newExpression, err = util.AddAlternativeLabelConstraintsToExpression(newExpression, constraints)
+	}
+	tracing.EndSpan(span, err)
+	if err != nil {
+		return "", authorizationError(err)
+	}
+	recordRewrite(req, newExpression)
+	return newExpression, nil
+}
+
+// rewriteSelector adds the label constraints for the project/domain scope to a series selector. If there are
+// alternative constraints, one selector is returned for each. The selector is also restricted to the metrics visible
+// with the user's roles.
+func rewriteSelector(req *http.Request, selector string, constraints []util.LabelConstraint) ([]string, error) {
+	_, span := tracing.StartSpan(req.Context(), "promql.rewrite", constraintAttributes(constraints)...)
+	var newSelectors []string
+	var err error
+	if filter := requestMetricNameFilter(req); filter != nil {
+		selector, err = util.AddMetricNameFilterToSelector(selector, filter)
+	}
+	if err == nil {
+		newSelectors, err = util.AddAlternativeLabelConstraintsToSelector(selector, constraints)
+	}
+	tracing.EndSpan(span, err)
+	if err != nil {
+		return nil, authorizationError(err)
+	}
+	recordRewrite(req, newSelectors...)
+	return newSelectors, nil
+}
+
+// authorizationError turns the rejection of hidden metrics and labels or of attempts to leave the scope into an
+// authorization error
+func authorizationError(err error) error {
+	switch err.(type) {
+	case util.MetricNotVisibleError, util.LabelNotVisibleError, util.ScopeViolationError:
+		return scopeError{err.Error()}
+	}
+	return err
+}
+
+func constraintAttributes(constraints []util.LabelConstraint) []attribute.KeyValue {
+	labels := make([]string, len(constraints))
+	values := 0
+	for i, c := range constraints {
+		labels[i] = c.Key
+		values += len(c.Values)
+	}
+	return []attribute.KeyValue{attribute.String("maia.label", strings.Join(labels, ",")), attribute.Int("maia.label_values", values)}
 }
 
 func policyEngine() *policy.Enforcer {
-	if policyEnforcer != nil {
-		return policyEnforcer
+	pe, err := initPolicyEngine()
+	if err != nil {
+		panic(err)
+	}
+	return pe
+}
+
+// initPolicyEngine sets up the policy engine lazily. If the policy cannot be loaded, the next call tries again.
+func initPolicyEngine() (*policy.Enforcer, error) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+
+	if policyEnforcer == nil {
+		pe, err := loadPolicy()
+		if err != nil {
+			return nil, err
+		}
+		policyEnforcer = pe
 	}
+	return policyEnforcer, nil
+}
 
-	// set up policy engine lazily
+// loadPolicy reads the policy file and creates a policy enforcer from it
+func loadPolicy() (*policy.Enforcer, error) {
 	bytes, err := ioutil.ReadFile(viper.GetString("keystone.policy_file"))
 	if err != nil {
-		panic(fmt.Errorf("Policy file %s not found: %s", viper.GetString("keystone.policy_file"), err))
+		return nil, fmt.Errorf("Policy file %s not found: %s", viper.GetString("keystone.policy_file"), err)
 	}
 	var rules map[string]string
 	err = json.Unmarshal(bytes, &rules)
 	if err != nil {
-		panic(err)
-	}
-	policyEnforcer, err = policy.NewEnforcer(rules)
-	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return policyEnforcer
+	return policy.NewEnforcer(rules)
 }
 
 func isPlainBasicAuth(req *http.Request) bool {
@@ -211,7 +382,7 @@ func isPlainBasicAuth(req *http.Request) bool {
 	return false
 }
 
-func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, rules []string) bool {
+func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, rules []string) *policy.Context {
 	util.LogDebug("authenticate")
 	matchedRules := []string{}
 
@@ -230,7 +401,9 @@ func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, r
 	}
 
 	// 2. authenticate
-	context, err := keystoneInstance.AuthenticateRequest(req, guessScope)
+	ctx, span := tracing.StartSpan(req.Context(), "authenticate")
+	context, err := keystoneInstance.AuthenticateRequest(req.WithContext(ctx), guessScope)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		code := err.StatusCode()
 		httpCode := http.StatusUnauthorized
@@ -254,7 +427,7 @@ func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, r
 			httpCode = http.StatusInternalServerError
 		}
 		http.Error(w, err.Error(), httpCode)
-		return false
+		return nil
 	} else if domainSet && req.Header.Get("X-User-Domain-Name") != domain {
 		// authentication was successful, but do the credentials match the given domain or do they perhaps belong to another user? we could not know in advance
 		// either the basic authentication credentials or the cookie do not match the domain in the URL
@@ -267,16 +440,19 @@ func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, r
 			// redirect to the domain that fits the user credentials
 			redirectToDomainRootPage(w, req)
 		}
-		return false
+		return nil
 	}
 
 	// 3. authorize
+	_, span = tracing.StartSpan(req.Context(), "policy.enforce", attribute.StringSlice("maia.rules", rules))
 	pe := policyEngine()
 	for _, rule := range rules {
 		if pe.Enforce(rule, *context) {
 			matchedRules = append(matchedRules, rule)
 		}
 	}
+	span.SetAttributes(attribute.StringSlice("maia.matched_rules", matchedRules))
+	span.End()
 
 	if len(matchedRules) == 0 {
 		// authenticated but not authorized
@@ -294,13 +470,13 @@ func authorizeRules(w http.ResponseWriter, req *http.Request, guessScope bool, r
 		reqRoles := viper.GetString("keystone.roles")
 		http.Error(w, fmt.Sprintf("User %s@%s does not have monitoring permissions on %s (actual roles: %s, required roles: %s)", username, userDomain, scope, actRoles, reqRoles), http.StatusForbidden)
 
-		return false
+		return nil
 	}
 
 	// set cookie
 	setAuthCookies(req, w)
 
-	return true
+	return context
 }
 
 func requestReauthentication(w http.ResponseWriter) {
@@ -327,7 +503,14 @@ func setAuthCookies(req *http.Request, w http.ResponseWriter) {
 func authorize(wrappedHandlerFunc func(w http.ResponseWriter, req *http.Request), guessScope bool, rule string) func(w http.ResponseWriter, req *http.Request) {
 
 	return func(w http.ResponseWriter, req *http.Request) {
-		if authorizeRules(w, req, guessScope, []string{rule}) {
+		recordHandler(req)
+		if policyContext := authorizeRules(w, req, guessScope, []string{rule}); policyContext != nil {
+			recordAuthorized(req)
+			req, err := withMetricNameFilter(withShowAll(req, *policyContext), *policyContext)
+			if err != nil {
+				ReturnPromError(w, err, http.StatusInternalServerError)
+				return
+			}
 			wrappedHandlerFunc(w, req)
 		}
 	}
@@ -354,3 +537,146 @@ func observeResponseSize(handlerFunc http.HandlerFunc, handler string) http.Hand
 
 	return promhttp.InstrumentHandlerResponseSize(durationSummary, http.HandlerFunc(handlerFunc)).ServeHTTP
 }
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	auditRecordKey
+	showAllKey
+	metricNameFilterKey
+)
+
+// requestInfo collects information about a request while it is being processed, so that it can be logged afterwards
+type requestInfo struct {
+	handler    string
+	authorized bool
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// recordHandler remembers the route template of the handler serving the request for the request log
+func recordHandler(req *http.Request) {
+	info, ok := req.Context().Value(requestInfoKey).(*requestInfo)
+	if !ok {
+		return
+	}
+	if route := mux.CurrentRoute(req); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			info.handler = tmpl
+		}
+	}
+}
+
+// withShowAll marks requests of cloud admins matching the keystone.show_all_rule policy rule. Their queries are not
+// restricted to the scope of the token.
+func withShowAll(req *http.Request, policyContext policy.Context) *http.Request {
+	rule := viper.GetString("keystone.show_all_rule")
+	if rule == "" || !policyEngine().Enforce(rule, policyContext) {
+		return req
+	}
+	util.LogDebug("Request of user %s is authorized for all tenants (%s)", req.Header.Get("X-User-Id"), rule)
+	return req.WithContext(context.WithValue(req.Context(), showAllKey, true))
+}
+
+// isShowAll checks whether the request may access the metrics of all tenants
+func isShowAll(req *http.Request) bool {
+	showAll, _ := req.Context().Value(showAllKey).(bool)
+	return showAll
+}
+
+// recordAuthorized remembers that the scope headers of the request have been set by the authentication
+func recordAuthorized(req *http.Request) {
+	if info, ok := req.Context().Value(requestInfoKey).(*requestInfo); ok {
+		info.authorized = true
+	}
+}
+
+// validRequestID checks whether a client-provided request ID is safe to use (e.g. in log records)
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// probePaths are hit by liveness/readiness probes and metric scrapers in short intervals: their requests are only
+// logged in debug mode
+var probePaths = map[string]bool{"/metrics": true, "/healthz": true, "/readyz": true}
+
+// logRequests assigns a request ID to every request and logs the completion of the request
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		requestID := req.Header.Get(util.RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = util.NewRequestID()
+		}
+		req.Header.Set(util.RequestIDHeader, requestID)
+		w.Header().Set(util.RequestIDHeader, requestID)
+
+		info := &requestInfo{handler: req.URL.Path}
+		ctx := context.WithValue(util.WithRequestID(req.Context(), requestID), requestInfoKey, info)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req.WithContext(ctx))
+
+		// the header is shared with the request passed to the handlers, so it contains the authentication results
+		h := req.Header
+		fields := util.Fields{
+			"request_id": requestID,
+			"method":     req.Method,
+			"handler":    info.handler,
+			"status":     recorder.status,
+			"duration":   time.Since(start).Seconds(),
+		}
+		for field, header := range map[string]string{"user_id": "X-User-Id", "user_name": "X-User-Name",
+			"user_domain_name": "X-User-Domain-Name", "project_id": "X-Project-Id", "domain_id": "X-Domain-Id"} {
+			if v := h.Get(header); v != "" {
+				fields[field] = v
+			}
+		}
+		if probePaths[req.URL.Path] {
+			util.LogDebugWithFields(fields, "request completed")
+		} else {
+			util.LogInfoWithFields(fields, "request completed")
+		}
+	})
+}
+
+// traceRequests continues the trace of incoming requests (W3C trace context) with a server span
+func traceRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, span := tracing.StartServerSpan(req, req.Method+" "+req.URL.Path)
+		span.SetAttributes(attribute.String("maia.request_id", util.RequestIDFromContext(ctx)))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req.WithContext(ctx))
+
+		// name the span after the route to keep the number of span names low
+		if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+			span.SetName(req.Method + " " + info.handler)
+		}
+		tracing.EndHTTPSpan(span, recorder.status)
+	})
+}
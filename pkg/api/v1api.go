@@ -22,16 +22,24 @@ package api
 import (
 	"net/http"
 
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/common/model"
+	"github.com/sapcc/maia/pkg/audit"
+	"github.com/sapcc/maia/pkg/cache"
 	"github.com/sapcc/maia/pkg/keystone"
 	"github.com/sapcc/maia/pkg/storage"
 	"github.com/sapcc/maia/pkg/util"
+	"github.com/sapcc/maia/pkg/version"
 	"github.com/spf13/viper"
 	"io/ioutil"
+	"os"
+	"runtime"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -39,6 +47,8 @@ import (
 type v1Provider struct {
 	keystone keystone.Driver
 	storage  storage.Driver
+	// cardinalityCache holds the results of the cardinality API per scope
+	cardinalityCache cache.Cache
 }
 
 //NewV1Handler creates a http.Handler that serves the Maia v1 API.
@@ -48,63 +58,125 @@ func NewV1Handler(keystone keystone.Driver, storage storage.Driver) http.Handler
 
 	r := mux.NewRouter()
 	p := &v1Provider{
-		keystone: keystone,
-		storage:  storage,
+		keystone:         keystone,
+		storage:          storage,
+		cardinalityCache: cache.NewMemoryCache(),
 	}
 
 	// tenant-aware query
 	r.Methods(http.MethodGet).Path("/query").HandlerFunc(authorize(
-		observeDuration(observeResponseSize(p.Query, "query"), "query"),
+		auditAccess(observeDuration(observeResponseSize(p.Query, "query"), "query"), audit.ActionRead),
 		false,
 		"metric:show"))
 	r.Methods(http.MethodGet).Path("/query_range").HandlerFunc(authorize(
-		observeDuration(observeResponseSize(p.QueryRange, "query_range"), "query_range"),
+		auditAccess(observeDuration(observeResponseSize(p.QueryRange, "query_range"), "query_range"), audit.ActionRead),
 		false,
 		"metric:show"))
+	r.Methods(http.MethodGet).Path("/query_exemplars").HandlerFunc(authorize(
+		auditAccess(observeDuration(observeResponseSize(p.QueryExemplars, "query_exemplars"), "query_exemplars"), audit.ActionRead),
+		false,
+		"metric:show"))
+	// explain how a query is restricted to the tenant (without executing it); audited since it discloses the child projects
+	r.Methods(http.MethodGet).Path("/explain").HandlerFunc(authorize(auditAccess(p.Explain, audit.ActionRead), false, "metric:show"))
 	// tenant-aware label value lists
-	r.Methods(http.MethodGet).Path("/label/{name}/values").HandlerFunc(authorize(p.LabelValues, false, "metric:list"))
+	r.Methods(http.MethodGet).Path("/label/{name}/values").HandlerFunc(authorize(auditAccess(p.LabelValues, audit.ActionList), false, "metric:list"))
+	// tenant-aware series statistics
+	r.Methods(http.MethodGet).Path("/cardinality").HandlerFunc(authorize(auditAccess(p.Cardinality, audit.ActionList), false, "metric:list"))
 	// tenant-aware series metadata
-	r.Methods(http.MethodGet).Path("/series").HandlerFunc(authorize(p.Series, false, "metric:list"))
+	r.Methods(http.MethodGet).Path("/series").HandlerFunc(authorize(auditAccess(p.Series, audit.ActionList), false, "metric:list"))
+	// status information (Grafana uses this to detect the Prometheus version)
+	r.Methods(http.MethodGet).Path("/status/buildinfo").HandlerFunc(authorize(p.BuildInfo, false, "metric:list"))
+	r.Methods(http.MethodGet).Path("/status/flags").HandlerFunc(authorize(p.Flags, false, "metric:list"))
+	r.Methods(http.MethodGet).Path("/status/runtimeinfo").HandlerFunc(authorize(p.RuntimeInfo, false, "metric:list"))
+	// administration
+	r.Methods(http.MethodPost).Path("/admin/cache/flush").HandlerFunc(authorize(p.FlushCache, false, "admin:flush_cache"))
 
 	return r
 }
 
 func (p *v1Provider) Query(w http.ResponseWriter, req *http.Request) {
-	labelKey, labelValue := scopeToLabelConstraint(req, p.keystone)
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	queryParams := req.URL.Query()
-	newQuery, err := util.AddLabelConstraintToExpression(queryParams.Get("query"), labelKey, labelValue)
+	newQuery, err := rewriteExpression(req, queryParams.Get("query"), constraints)
 	if err != nil {
 		ReturnPromError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	resp, err := p.storage.Query(newQuery, queryParams.Get("time"), queryParams.Get("timeout"), req.Header.Get("Accept"))
+	resp, err := p.storage.Query(req.Context(), newQuery, queryParams.Get("time"), queryParams.Get("timeout"), req.Header.Get("Accept"))
 	if err != nil {
 		ReturnPromError(w, err, http.StatusServiceUnavailable)
 		return
 	}
 
-	ReturnResponse(w, resp)
+	returnRedactedQueryResponse(w, resp, rules)
 }
 
 func (p *v1Provider) QueryRange(w http.ResponseWriter, req *http.Request) {
-	labelKey, labelValue := scopeToLabelConstraint(req, p.keystone)
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	queryParams := req.URL.Query()
-	newQuery, err := util.AddLabelConstraintToExpression(queryParams.Get("query"), labelKey, labelValue)
+	newQuery, err := rewriteExpression(req, queryParams.Get("query"), constraints)
 	if err != nil {
 		ReturnPromError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	resp, err := p.storage.QueryRange(newQuery, queryParams.Get("start"), queryParams.Get("end"), queryParams.Get("step"), queryParams.Get("timeout"), req.Header.Get("Accept"))
+	resp, err := p.storage.QueryRange(req.Context(), newQuery, queryParams.Get("start"), queryParams.Get("end"), queryParams.Get("step"), queryParams.Get("timeout"), req.Header.Get("Accept"))
 	if err != nil {
 		ReturnPromError(w, err, http.StatusServiceUnavailable)
 		return
 	}
 
-	ReturnResponse(w, resp)
+	returnRedactedQueryResponse(w, resp, rules)
+}
+
+// QueryExemplars returns the exemplars of the series selected by the query, e.g. to link them with traces
+func (p *v1Provider) QueryExemplars(w http.ResponseWriter, req *http.Request) {
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	queryParams := req.URL.Query()
+	newQuery, err := rewriteExpression(req, queryParams.Get("query"), constraints)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resp, err := p.storage.QueryExemplars(req.Context(), newQuery, queryParams.Get("start"), queryParams.Get("end"), req.Header.Get("Accept"))
+	if err != nil {
+		ReturnPromError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	returnRedactedExemplarsResponse(w, resp, rules)
 }
 
 // LabelValues utilizes the series API in order to implement a tenant-aware list.
@@ -118,15 +190,41 @@ func (p *v1Provider) LabelValues(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	labelKey, labelValues := scopeToLabelConstraint(req, p.keystone)
-	selector, err := util.AddLabelConstraintToSelector("{"+string(name)+"!=\"\"}", labelKey, labelValues)
+	constraints, err := scopeToLabelConstraints(req, p.keystone)
 	if err != nil {
-		ReturnPromError(w, err, http.StatusBadRequest)
+		ReturnPromError(w, err, http.StatusForbidden)
+		return
+	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// renamed labels are stored under a different name, redacted labels have no visible values at all
+	sourceNames := []model.LabelName{name}
+	if rules != nil {
+		sourceNames = rules.sourceNames(name)
+	}
+	var result storage.LabelValuesResponse
+	result.Status = storage.StatusSuccess
+	result.Data = model.LabelValues{}
+	if len(sourceNames) == 0 {
+		ReturnJSON(w, 200, &result)
+		return
+	}
+	var selectors []string
+	for _, sourceName := range sourceNames {
+		sourceSelectors, err := rewriteSelector(req, "{"+string(sourceName)+"!=\"\"}", constraints)
+		if err != nil {
+			ReturnPromError(w, err, http.StatusBadRequest)
+			return
+		}
+		selectors = append(selectors, sourceSelectors...)
 	}
 
 	start := time.Now().Add(-ttl)
 	end := time.Now()
-	resp, err := p.storage.Series([]string{selector}, start.Format(time.RFC3339), end.Format(time.RFC3339), req.Header.Get("Accept"))
+	resp, err := p.storage.Series(req.Context(), selectors, start.Format(time.RFC3339), end.Format(time.RFC3339), req.Header.Get("Accept"))
 	if err != nil {
 		ReturnPromError(w, err, http.StatusBadGateway)
 		return
@@ -146,15 +244,20 @@ func (p *v1Provider) LabelValues(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	// collect unique values from 1000x bigger :( series list
+	filter := requestMetricNameFilter(req)
 	unique := map[model.LabelValue]bool{}
 	for _, lset := range sr.Data {
+		if rules != nil {
+			lset = rules.applyToLabelSet(lset)
+		}
 		v := lset[name]
+		if v == "" || (name == model.MetricNameLabel && filter != nil && !filter.Visible(string(v))) {
+			continue
+		}
 		unique[v] = true
 	}
 	// transform into expected result type
-	var result storage.LabelValuesResponse
 	result.Status = sr.Status
-	result.Data = model.LabelValues{}
 	for k := range unique {
 		result.Data = append(result.Data, k)
 	}
@@ -169,12 +272,128 @@ func (p *v1Provider) Series(w http.ResponseWriter, req *http.Request) {
 		ReturnPromError(w, err, http.StatusBadRequest)
 		return
 	}
+	rules, err := responseLabelRules(req)
+	if err != nil {
+		ReturnPromError(w, err, http.StatusInternalServerError)
+		return
+	}
 	queryParams := req.URL.Query()
-	resp, err := p.storage.Series(*selectors, queryParams.Get("start"), queryParams.Get("end"), req.Header.Get("Accept"))
+	resp, err := p.storage.Series(req.Context(), *selectors, queryParams.Get("start"), queryParams.Get("end"), req.Header.Get("Accept"))
 	if err != nil {
 		ReturnPromError(w, err, http.StatusBadGateway)
 		return
 	}
 
-	ReturnResponse(w, resp)
+	returnRedactedSeriesResponse(w, resp, rules)
+}
+
+// buildInfoData is the payload of the /status/buildinfo API. The top-level fields describe the backend, so that
+// clients like Grafana enable the features of the TSDB actually serving the data. Maia's own build information
+// is added as a separate field.
+type buildInfoData struct {
+	version.Info
+	Maia version.Info `json:"maia"`
+}
+
+// BuildInfo reports the version of the Prometheus backend together with the version of Maia. When the backend cannot
+// be reached, the backend fields remain empty.
+func (p *v1Provider) BuildInfo(w http.ResponseWriter, req *http.Request) {
+	var sr storage.StatusResponse
+	if err := p.fetchStatus(req.Context(), "buildinfo", &sr); err != nil {
+		util.LogWarning("Could not obtain build information of the backend: %v", err)
+	}
+
+	data := buildInfoData{
+		Info: version.Info{
+			Version:   sr.Data["version"],
+			Revision:  sr.Data["revision"],
+			Branch:    sr.Data["branch"],
+			BuildUser: sr.Data["buildUser"],
+			BuildDate: sr.Data["buildDate"],
+			GoVersion: sr.Data["goVersion"],
+		},
+		Maia: version.BuildInfo(),
+	}
+	ReturnJSON(w, http.StatusOK, struct {
+		Status storage.Status `json:"status"`
+		Data   buildInfoData  `json:"data"`
+	}{storage.StatusSuccess, data})
+}
+
+// Flags reports the subset of the backend's command-line flags that is configured as safe to expose
+// (maia.status_flags). Everything else (e.g. paths, URLs of the infrastructure) is omitted.
+func (p *v1Provider) Flags(w http.ResponseWriter, req *http.Request) {
+	var sr storage.StatusResponse
+	if err := p.fetchStatus(req.Context(), "flags", &sr); err != nil {
+		ReturnPromError(w, err, http.StatusBadGateway)
+		return
+	}
+
+	result := storage.StatusResponse{Status: storage.StatusSuccess, Data: map[string]string{}}
+	for _, flag := range strings.Split(viper.GetString("maia.status_flags"), ",") {
+		flag = strings.TrimSpace(flag)
+		if v, ok := sr.Data[flag]; ok {
+			result.Data[flag] = v
+		}
+	}
+
+	ReturnJSON(w, http.StatusOK, &result)
+}
+
+// RuntimeInfo reports runtime properties of the Maia process (not the backend)
+func (p *v1Provider) RuntimeInfo(w http.ResponseWriter, req *http.Request) {
+	data := struct {
+		StartTime      time.Time `json:"startTime"`
+		GoroutineCount int       `json:"goroutineCount"`
+		GOMAXPROCS     int       `json:"GOMAXPROCS"`
+		GOGC           string    `json:"GOGC"`
+		GODEBUG        string    `json:"GODEBUG"`
+	}{
+		StartTime:      startTime,
+		GoroutineCount: runtime.NumGoroutine(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		GOGC:           os.Getenv("GOGC"),
+		GODEBUG:        os.Getenv("GODEBUG"),
+	}
+
+	ReturnJSON(w, http.StatusOK, struct {
+		Status storage.Status `json:"status"`
+		Data   interface{}    `json:"data"`
+	}{storage.StatusSuccess, data})
+}
+
+// fetchStatus retrieves one of the /status/... documents from the backend
+func (p *v1Provider) fetchStatus(ctx context.Context, kind string, result *storage.StatusResponse) error {
+	resp, err := p.storage.Status(ctx, kind, storage.JSON)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend does not provide /status/%s: %s", kind, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, result)
+}
+
+// FlushCache removes cached Keystone data (tokens, project trees, role assignments) of a user and/or project,
+// e.g. to make revoked tokens or changed role assignments effective immediately. The project is passed as
+// flush_project_id since project_id selects the authorization scope.
+func (p *v1Provider) FlushCache(w http.ResponseWriter, req *http.Request) {
+	userID := req.FormValue("user_id")
+	projectID := req.FormValue("flush_project_id")
+	if userID == "" && projectID == "" {
+		ReturnPromError(w, errors.New("no user_id or flush_project_id parameter provided"), http.StatusBadRequest)
+		return
+	}
+
+	p.keystone.FlushCache(userID, projectID)
+	util.LogInfo("Flushed caches of user %q and project %q on behalf of %s@%s", userID, projectID,
+		req.Header.Get("X-User-Name"), req.Header.Get("X-User-Domain-Name"))
+	w.WriteHeader(http.StatusNoContent)
 }
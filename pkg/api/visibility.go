@@ -0,0 +1,97 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/databus23/goslo.policy"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// metricNameFilter determines the metrics visible to a user from the allow and deny lists of the roles (section
+// metric_visibility). Only roles with a configuration are considered. A metric is visible if it is allowed by one of
+// them (no allow list = all metrics) and not denied by any of them. The result is nil if the metrics are not restricted.
+func metricNameFilter(roles []string) (*util.MetricNameFilter, error) {
+	allowAll := false
+	allow := map[string]bool{}
+	deny := map[string]bool{}
+	for _, role := range roles {
+		key := "metric_visibility." + strings.ToLower(role)
+		if !viper.IsSet(key) {
+			continue
+		}
+		if roleAllow := parseAllowlist(viper.GetString(key + ".allow")); roleAllow != nil {
+			for pattern := range roleAllow {
+				allow[pattern] = true
+			}
+		} else {
+			allowAll = true
+		}
+		for pattern := range parseAllowlist(viper.GetString(key + ".deny")) {
+			deny[pattern] = true
+		}
+	}
+
+	var allowPatterns, denyPatterns []string
+	if !allowAll {
+		for pattern := range allow {
+			allowPatterns = append(allowPatterns, pattern)
+		}
+	}
+	for pattern := range deny {
+		denyPatterns = append(denyPatterns, pattern)
+	}
+	if len(allowPatterns) == 0 && len(denyPatterns) == 0 {
+		return nil, nil
+	}
+	sort.Strings(allowPatterns)
+	sort.Strings(denyPatterns)
+
+	filter, err := util.NewMetricNameFilter(strings.Join(allowPatterns, "|"), strings.Join(denyPatterns, "|"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Maia configuration (metric_visibility): %s", err.Error())
+	}
+	return filter, nil
+}
+
+// withMetricNameFilter attaches the metric name filter resulting from the user's roles to the request. Cloud admins
+// (see withShowAll) see all metrics.
+func withMetricNameFilter(req *http.Request, policyContext policy.Context) (*http.Request, error) {
+	if isShowAll(req) {
+		return req, nil
+	}
+	filter, err := metricNameFilter(policyContext.Roles)
+	if err != nil || filter == nil {
+		return req, err
+	}
+	return req.WithContext(context.WithValue(req.Context(), metricNameFilterKey, filter)), nil
+}
+
+// requestMetricNameFilter returns the metric name filter of the request (nil if the metrics are not restricted)
+func requestMetricNameFilter(req *http.Request) *util.MetricNameFilter {
+	filter, _ := req.Context().Value(metricNameFilterKey).(*util.MetricNameFilter)
+	return filter
+}
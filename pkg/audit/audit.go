@@ -0,0 +1,222 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package audit
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackpressureDrop discards events when the buffer is full (the request is not delayed)
+	BackpressureDrop = "drop"
+	// BackpressureBlock delays the request until there is space in the buffer (no event is lost)
+	BackpressureBlock = "block"
+)
+
+var droppedEventsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "maia_audit_events_dropped_count", Help: "Number of audit events dropped because the buffer was full or the sink failed"})
+var sinkErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "maia_audit_sink_errors_count", Help: "Number of failed attempts to deliver audit events to the sink"})
+
+func init() {
+	prometheus.MustRegister(droppedEventsCounter, sinkErrorsCounter)
+}
+
+// Auditor buffers audit events and delivers them to a sink in the background
+type Auditor struct {
+	events        chan Event
+	sink          Sink
+	block         bool
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryInterval time.Duration
+	// closed by Close to make the background delivery flush the buffer and stop (which closes stopped)
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewAuditor is a factory method which creates an auditor based on configuration settings.
+// It returns nil if auditing is disabled.
+func NewAuditor() *Auditor {
+	sinkName := viper.GetString("audit.sink")
+	var sink Sink
+	switch sinkName {
+	case "":
+		return nil
+	case "file":
+		s, err := NewFileSink(viper.GetString("audit.file_path"))
+		if err != nil {
+			panic(err)
+		}
+		sink = s
+	case "http":
+		sink = NewHTTPSink(viper.GetString("audit.http_url"))
+	default:
+		panic(fmt.Errorf("Invalid audit.sink setting: %s", sinkName))
+	}
+
+	policy := viper.GetString("audit.backpressure")
+	if policy != BackpressureDrop && policy != BackpressureBlock {
+		panic(fmt.Errorf("Invalid audit.backpressure setting: %s", policy))
+	}
+
+	util.LogInfo("Writing audit events to %s sink", sinkName)
+	return New(sink, viper.GetInt("audit.buffer_size"), viper.GetInt("audit.batch_size"),
+		viper.GetDuration("audit.flush_interval"), policy, viper.GetInt("audit.max_retries"),
+		viper.GetDuration("audit.retry_interval"))
+}
+
+// New creates an auditor delivering events to the given sink and starts the background delivery. A batch that
+// cannot be delivered is retried up to maxRetries times, waiting retryInterval before the first retry and twice as
+// long before each further one.
+func New(sink Sink, bufferSize, batchSize int, flushInterval time.Duration, backpressure string, maxRetries int,
+	retryInterval time.Duration) *Auditor {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	a := &Auditor{
+		events:        make(chan Event, bufferSize),
+		sink:          sink,
+		block:         backpressure == BackpressureBlock,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxRetries:    maxRetries,
+		retryInterval: retryInterval,
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Record queues an event for delivery. Depending on the backpressure policy it either blocks or
+// drops the event when the buffer is full. It must not be called after Close.
+func (a *Auditor) Record(event Event) {
+	if a.block {
+		a.events <- event
+		return
+	}
+
+	select {
+	case a.events <- event:
+	default:
+		droppedEventsCounter.Inc()
+		util.LogWarning("Audit buffer full: dropping event %s", event.ID)
+	}
+}
+
+func (a *Auditor) run() {
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, a.batchSize)
+	for {
+		select {
+		case event := <-a.events:
+			batch = append(batch, event)
+			if len(batch) < a.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-a.stop:
+			a.drain(batch)
+			close(a.stopped)
+			return
+		}
+		a.flush(batch)
+		batch = make([]Event, 0, a.batchSize)
+	}
+}
+
+// drain delivers the given batch together with all events remaining in the buffer
+func (a *Auditor) drain(batch []Event) {
+	for {
+		select {
+		case event := <-a.events:
+			batch = append(batch, event)
+			if len(batch) >= a.batchSize {
+				a.flush(batch)
+				batch = make([]Event, 0, a.batchSize)
+			}
+		default:
+			if len(batch) > 0 {
+				a.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+// Close delivers the buffered events (with retries, if necessary) and closes the sink. It is called on shutdown,
+// after the last event has been recorded.
+func (a *Auditor) Close() error {
+	close(a.stop)
+	<-a.stopped
+	if closer, ok := a.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// flush delivers a batch to the sink. New events are buffered meanwhile, so the backpressure policy applies while
+// the delivery is retried.
+func (a *Auditor) flush(batch []Event) {
+	wait := a.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := a.sink.Send(batch)
+		if err == nil {
+			return
+		}
+		sinkErrorsCounter.Inc()
+		if attempt >= a.maxRetries {
+			droppedEventsCounter.Add(float64(len(batch)))
+			util.LogError("Could not deliver %d audit events: %s", len(batch), err.Error())
+			return
+		}
+		util.LogWarning("Could not deliver %d audit events (retrying in %s): %s", len(batch), wait, err.Error())
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// newUUID generates a random (version 4) UUID as required for CADF event IDs
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
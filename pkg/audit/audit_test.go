@@ -0,0 +1,191 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// channelSink passes all events to a channel
+type channelSink struct {
+	events chan Event
+}
+
+func (s channelSink) Send(events []Event) error {
+	for _, e := range events {
+		s.events <- e
+	}
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	sink := channelSink{events: make(chan Event, 10)}
+	a := New(sink, 10, 2, 10*time.Millisecond, BackpressureBlock, 0, 0)
+
+	a.Record(NewEvent(DataAccess{Action: ActionRead, UserID: "u12345", ProjectID: "12345", ChildProjects: []string{"67890"},
+		Queries: []string{"up"}, RewrittenQueries: []string{"up{project_id=~\"12345|67890\"}"}, StatusCode: 200, ResponseSize: 42}))
+
+	// the batch is incomplete, so the event is delivered by the periodic flush
+	select {
+	case e := <-sink.events:
+		if e.Outcome != OutcomeSuccess || e.Target.ID != "12345" || e.Target.TypeURI != projectTypeURI || e.Initiator.ID != "u12345" {
+			t.Errorf("Unexpected event: %+v", e)
+		}
+		if e.Reason == nil || e.Reason.ReasonCode != "200" {
+			t.Errorf("Unexpected reason: %+v", e.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Audit event has not been delivered")
+	}
+}
+
+// flakySink fails the first deliveries before passing events on to a channel
+type flakySink struct {
+	failures int
+	channelSink
+}
+
+func (s *flakySink) Send(events []Event) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	return s.channelSink.Send(events)
+}
+
+func TestAuditor_retry(t *testing.T) {
+	sink := &flakySink{failures: 2, channelSink: channelSink{events: make(chan Event, 10)}}
+	a := New(sink, 10, 1, 10*time.Millisecond, BackpressureBlock, 2, time.Millisecond)
+
+	a.Record(NewEvent(DataAccess{Action: ActionRead, UserID: "u12345", ProjectID: "12345", StatusCode: 200}))
+
+	select {
+	case e := <-sink.events:
+		if e.Initiator.ID != "u12345" {
+			t.Errorf("Unexpected event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Audit event has not been delivered after retries")
+	}
+}
+
+func TestNewEvent_domainFailure(t *testing.T) {
+	e := NewEvent(DataAccess{Action: ActionList, UserID: "u12345", DomainID: "77777", DomainName: "testdomain", StatusCode: 502})
+
+	if e.Outcome != OutcomeFailure {
+		t.Errorf("Expected outcome %s, got %s", OutcomeFailure, e.Outcome)
+	}
+	if e.Target.TypeURI != domainTypeURI || e.Target.ID != "77777" {
+		t.Errorf("Expected domain 77777 as target, got %+v", e.Target)
+	}
+}
+
+func TestAuditor_drop(t *testing.T) {
+	// without delivery in the background, the buffer fills up
+	a := &Auditor{events: make(chan Event, 1)}
+
+	a.Record(Event{ID: "1"})
+	// must not block
+	a.Record(Event{ID: "2"})
+
+	if len(a.events) != 1 {
+		t.Errorf("Expected one buffered event, got %d", len(a.events))
+	}
+}
+
+// closingSink records whether it has been closed
+type closingSink struct {
+	channelSink
+	closed bool
+}
+
+func (s *closingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAuditor_close(t *testing.T) {
+	sink := &closingSink{channelSink: channelSink{events: make(chan Event, 10)}}
+	// neither the batch size nor the flush interval is reached before closing
+	a := New(sink, 10, 5, time.Hour, BackpressureBlock, 0, 0)
+
+	for _, id := range []string{"1", "2", "3"} {
+		a.Record(Event{ID: id})
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 3 {
+		t.Errorf("Expected 3 events to be delivered on close, got %d", len(sink.events))
+	}
+	if !sink.closed {
+		t.Error("Expected the sink to be closed")
+	}
+}
+
+// brokenFile accepts limit bytes and fails to write more
+type brokenFile struct {
+	bytes.Buffer
+	limit int
+}
+
+func (f *brokenFile) Write(p []byte) (int, error) {
+	if room := f.limit - f.Len(); room < len(p) {
+		n, _ := f.Buffer.Write(p[:room])
+		return n, errors.New("disk full")
+	}
+	return f.Buffer.Write(p)
+}
+
+func (f *brokenFile) Sync() error  { return nil }
+func (f *brokenFile) Close() error { return nil }
+
+func TestFileSink_partialWrite(t *testing.T) {
+	file := &brokenFile{limit: 100}
+	sink := &fileSink{file: file}
+	batch := []Event{NewEvent(DataAccess{Action: ActionRead, UserID: "u1", ProjectID: "p1", StatusCode: 200}),
+		NewEvent(DataAccess{Action: ActionRead, UserID: "u2", ProjectID: "p2", StatusCode: 200})}
+
+	if err := sink.Send(batch); err == nil {
+		t.Fatal("Expected the first attempt to fail")
+	}
+	// the retry continues where the failed attempt stopped
+	file.limit = 1 << 20
+	if err := sink.Send(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(file.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events to be written once, got %d lines", len(lines))
+	}
+	for i, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.ID != batch[i].ID {
+			t.Errorf("Unexpected line %d: %s (%v)", i, line, err)
+		}
+	}
+}
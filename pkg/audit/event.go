@@ -0,0 +1,157 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package audit
+
+import (
+	"strconv"
+	"time"
+)
+
+// CADF (Cloud Auditing Data Federation) constants as used by OpenStack services
+const (
+	eventTypeURI    = "http://schemas.dmtf.org/cloud/audit/1.0/event"
+	eventTypeAction = "activity"
+	userTypeURI     = "service/security/account/user"
+	projectTypeURI  = "data/security/project"
+	domainTypeURI   = "data/security/domain"
+	serviceTypeURI  = "service/metrics"
+
+	// OutcomeSuccess denotes a successful data access
+	OutcomeSuccess = "success"
+	// OutcomeFailure denotes a failed data access
+	OutcomeFailure = "failure"
+	// ActionRead is used for queries returning measurement data
+	ActionRead = "read"
+	// ActionList is used for listing series or label values
+	ActionList = "read/list"
+)
+
+// Event is a CADF event describing an access to tenant data
+type Event struct {
+	TypeURI     string       `json:"typeURI"`
+	ID          string       `json:"id"`
+	EventTime   string       `json:"eventTime"`
+	EventType   string       `json:"eventType"`
+	Action      string       `json:"action"`
+	Outcome     string       `json:"outcome"`
+	Reason      *Reason      `json:"reason,omitempty"`
+	Initiator   Resource     `json:"initiator"`
+	Target      Resource     `json:"target"`
+	Observer    Resource     `json:"observer"`
+	RequestPath string       `json:"requestPath,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Resource is a CADF resource (initiator, target or observer of an event)
+type Resource struct {
+	TypeURI   string `json:"typeURI"`
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Domain    string `json:"domain,omitempty"`
+	ProjectID string `json:"project_id,omitempty"`
+	DomainID  string `json:"domain_id,omitempty"`
+	Host      *Host  `json:"host,omitempty"`
+}
+
+// Host describes the client of a request
+type Host struct {
+	Address string `json:"address,omitempty"`
+	Agent   string `json:"agent,omitempty"`
+}
+
+// Reason contains the HTTP status of the request
+type Reason struct {
+	ReasonType string `json:"reasonType"`
+	ReasonCode string `json:"reasonCode"`
+}
+
+// Attachment carries additional, domain-specific information of an event
+type Attachment struct {
+	Name    string      `json:"name"`
+	TypeURI string      `json:"typeURI"`
+	Content interface{} `json:"content"`
+}
+
+// DataAccess contains the details of a data-access request needed to build an audit event
+type DataAccess struct {
+	Action         string
+	RequestPath    string
+	ClientAddress  string
+	UserAgent      string
+	UserID         string
+	UserName       string
+	UserDomainName string
+	ProjectID      string
+	ProjectName    string
+	DomainID       string
+	DomainName     string
+	// ChildProjects contains the projects that have been included in the label constraint
+	ChildProjects []string
+	// Queries contains the original expressions/selectors
+	Queries []string
+	// RewrittenQueries contains the expressions/selectors after adding the label constraint
+	RewrittenQueries []string
+	// Unrestricted is set if the queries have not been restricted to the scope (cloud admins)
+	Unrestricted bool
+	StatusCode   int
+	ResponseSize int
+}
+
+// NewEvent creates a CADF event from a data-access record
+func NewEvent(access DataAccess) Event {
+	outcome := OutcomeSuccess
+	if access.StatusCode >= 400 {
+		outcome = OutcomeFailure
+	}
+
+	target := Resource{TypeURI: projectTypeURI, ID: access.ProjectID, Name: access.ProjectName}
+	if access.ProjectID == "" {
+		target = Resource{TypeURI: domainTypeURI, ID: access.DomainID, Name: access.DomainName}
+	}
+
+	return Event{
+		TypeURI:   eventTypeURI,
+		ID:        newUUID(),
+		EventTime: time.Now().UTC().Format("2006-01-02T15:04:05.000000-0700"),
+		EventType: eventTypeAction,
+		Action:    access.Action,
+		Outcome:   outcome,
+		Reason:    &Reason{ReasonType: "HTTP", ReasonCode: strconv.Itoa(access.StatusCode)},
+		Initiator: Resource{
+			TypeURI:   userTypeURI,
+			ID:        access.UserID,
+			Name:      access.UserName,
+			Domain:    access.UserDomainName,
+			ProjectID: access.ProjectID,
+			DomainID:  access.DomainID,
+			Host:      &Host{Address: access.ClientAddress, Agent: access.UserAgent},
+		},
+		Target:      target,
+		Observer:    Resource{TypeURI: serviceTypeURI, ID: "maia", Name: "maia"},
+		RequestPath: access.RequestPath,
+		Attachments: []Attachment{
+			{Name: "child_projects", TypeURI: "mime:application/json", Content: access.ChildProjects},
+			{Name: "query", TypeURI: "mime:application/json", Content: access.Queries},
+			{Name: "rewritten_query", TypeURI: "mime:application/json", Content: access.RewrittenQueries},
+			{Name: "response_size", TypeURI: "xs:int", Content: access.ResponseSize},
+			{Name: "unrestricted", TypeURI: "xs:boolean", Content: access.Unrestricted},
+		},
+	}
+}
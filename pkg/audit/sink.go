@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink is the destination of audit events
+type Sink interface {
+	// Send delivers a batch of events
+	Send(events []Event) error
+}
+
+// fileSink appends events to a file (one JSON document per line)
+type fileSink struct {
+	mutex sync.Mutex
+	file  syncWriter
+	// a batch that could only be written partially is resumed after the bytes already written when it is retried
+	partialBatchID string
+	partialWritten int
+}
+
+// syncWriter is the part of *os.File used by the file sink
+type syncWriter interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// NewFileSink creates a sink writing to the file at the given path
+func NewFileSink(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log %s: %s", path, err.Error())
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Send(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := buf.Bytes()
+	if s.partialBatchID == events[0].ID {
+		data = data[s.partialWritten:]
+	} else {
+		s.partialBatchID, s.partialWritten = events[0].ID, 0
+	}
+	n, err := s.file.Write(data)
+	s.partialWritten += n
+	if err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.partialBatchID, s.partialWritten = "", 0
+	return nil
+}
+
+// Close closes the file
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// httpSink posts events to an HTTP endpoint (as JSON array)
+type httpSink struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewHTTPSink creates a sink posting events to the given URL
+func NewHTTPSink(url string) Sink {
+	return &httpSink{url: url, httpClient: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *httpSink) Send(events []Event) error {
+	buf, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Post(s.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit sink %s responded with %s", s.url, resp.Status)
+	}
+	return nil
+}
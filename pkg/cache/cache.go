@@ -0,0 +1,66 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package cache
+
+import (
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Cache is a key-value store with expiring entries. Values are stored in serialized form, so that the cache can be
+// shared between processes. Caching is best-effort: errors of the underlying store are logged and reported as misses.
+type Cache interface {
+	// Get returns the value stored under the key
+	Get(key string) ([]byte, bool)
+	// Set stores the value under the key. A ttl of 0 means that the entry does not expire.
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete removes the value stored under the key
+	Delete(key string)
+}
+
+// memoryCache is a cache local to the process
+type memoryCache struct {
+	cache *gocache.Cache
+}
+
+// NewMemoryCache creates a cache local to the process
+func NewMemoryCache() Cache {
+	return &memoryCache{cache: gocache.New(gocache.NoExpiration, time.Minute)}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	value, found := c.cache.Get(key)
+	if !found {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = gocache.NoExpiration
+	}
+	c.cache.Set(key, value, ttl)
+}
+
+func (c *memoryCache) Delete(key string) {
+	c.cache.Delete(key)
+}
@@ -0,0 +1,217 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memcachedStandIn implements the part of the memcached text protocol used by the client (get/gets, set, delete)
+type memcachedStandIn struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	items    map[string]standInItem
+}
+
+type standInItem struct {
+	value   []byte
+	flags   string
+	expires time.Time
+}
+
+func newMemcachedStandIn(t *testing.T) *memcachedStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &memcachedStandIn{listener: listener, items: map[string]standInItem{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *memcachedStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		s.mutex.Lock()
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if item, ok := s.items[key]; ok && (item.expires.IsZero() || time.Now().Before(item.expires)) {
+					fmt.Fprintf(conn, "VALUE %s %s %d 1\r\n%s\r\n", key, item.flags, len(item.value), item.value)
+				}
+			}
+			io.WriteString(conn, "END\r\n")
+		case "set":
+			// set <key> <flags> <exptime> <bytes>
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			io.ReadFull(r, data)
+			item := standInItem{value: data[:size], flags: fields[2]}
+			if exptime, _ := strconv.Atoi(fields[3]); exptime > 0 {
+				item.expires = time.Now().Add(time.Duration(exptime) * time.Second)
+			}
+			s.items[fields[1]] = item
+			io.WriteString(conn, "STORED\r\n")
+		case "delete":
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				io.WriteString(conn, "DELETED\r\n")
+			} else {
+				io.WriteString(conn, "NOT_FOUND\r\n")
+			}
+		default:
+			io.WriteString(conn, "ERROR\r\n")
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func TestCaches(t *testing.T) {
+	server := newMemcachedStandIn(t)
+	defer server.listener.Close()
+
+	for name, c := range map[string]Cache{
+		"memory":    NewMemoryCache(),
+		"memcached": NewMemcachedCache("test", server.listener.Addr().String()),
+	} {
+		if _, found := c.Get("key"); found {
+			t.Errorf("%s: unexpected hit on empty cache", name)
+		}
+
+		c.Set("key", []byte("value"), 0)
+		c.Set("short-lived", []byte("value"), time.Second)
+		if value, found := c.Get("key"); !found || string(value) != "value" {
+			t.Errorf("%s: expected value, got %q (found: %v)", name, value, found)
+		}
+
+		c.Delete("key")
+		if _, found := c.Get("key"); found {
+			t.Errorf("%s: unexpected hit after delete", name)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		if _, found := c.Get("short-lived"); found {
+			t.Errorf("%s: unexpected hit after expiry", name)
+		}
+	}
+}
+
+func TestMemcachedCache_namespaces(t *testing.T) {
+	server := newMemcachedStandIn(t)
+	defer server.listener.Close()
+
+	tokens := NewMemcachedCache("tokens", server.listener.Addr().String())
+	users := NewMemcachedCache("users", server.listener.Addr().String())
+	tokens.Set("key", []byte("token"), 0)
+	users.Set("key", []byte("user"), 0)
+
+	if value, _ := tokens.Get("key"); string(value) != "token" {
+		t.Errorf("expected entries of caches sharing servers to be separated, got %q", value)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for key := range server.items {
+		if strings.Contains(key, "key") {
+			t.Errorf("expected keys to be hashed, got %s", key)
+		}
+	}
+}
+
+func TestMemcachedCache_unavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// errors are treated as cache misses
+	c := NewMemcachedCache("test", addr)
+	c.Set("key", []byte("value"), 0)
+	if _, found := c.Get("key"); found {
+		t.Error("unexpected hit without memcached server")
+	}
+}
+
+func TestEncryptedCache(t *testing.T) {
+	server := newMemcachedStandIn(t)
+	defer server.listener.Close()
+
+	c := NewEncryptedCache(NewMemcachedCache("test", server.listener.Addr().String()), "secret")
+	c.Set("key", []byte("token-data"), 0)
+	if value, found := c.Get("key"); !found || string(value) != "token-data" {
+		t.Errorf("expected value, got %q (found: %v)", value, found)
+	}
+
+	server.mutex.Lock()
+	for key, item := range server.items {
+		if strings.Contains(string(item.value), "token-data") {
+			t.Errorf("expected value to be encrypted, got %q", item.value)
+		}
+		// tamper with the entry
+		item.value[len(item.value)-1] ^= 1
+		server.items[key] = item
+	}
+	server.mutex.Unlock()
+	if _, found := c.Get("key"); found {
+		t.Error("unexpected hit on tampered entry")
+	}
+
+	// entries can neither be read with another secret nor be moved to another key
+	memory := NewMemoryCache()
+	encrypted := NewEncryptedCache(memory, "secret").(*encryptedCache)
+	other := NewEncryptedCache(memory, "other-secret").(*encryptedCache)
+	encrypted.Set("key", []byte("token-data"), 0)
+	data, _ := memory.Get(encrypted.key("key"))
+	memory.Set(other.key("key"), data, 0)
+	memory.Set(encrypted.key("other-key"), data, 0)
+	if _, found := other.Get("key"); found {
+		t.Error("unexpected hit on entry encrypted with another secret")
+	}
+	if _, found := encrypted.Get("other-key"); found {
+		t.Error("unexpected hit on entry moved to another key")
+	}
+}
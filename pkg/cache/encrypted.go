@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/sapcc/maia/pkg/util"
+)
+
+// encryptedCache encrypts and authenticates the entries of another cache with a shared secret, so that entries in a
+// shared store (e.g. memcached) can neither be read nor forged without knowing the secret.
+type encryptedCache struct {
+	cache  Cache
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// NewEncryptedCache wraps a cache so that entries are encrypted with AES-GCM. The encryption and key-hashing keys
+// are derived from the secret, which has to be the same for all processes sharing the cache.
+func NewEncryptedCache(c Cache, secret string) Cache {
+	block, err := aes.NewCipher(deriveKey(secret, "encryption"))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &encryptedCache{cache: c, aead: aead, macKey: deriveKey(secret, "key")}
+}
+
+// deriveKey derives a 256 bit key for the given purpose from the secret
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("maia cache " + purpose))
+	return mac.Sum(nil)
+}
+
+// key maps keys using a keyed hash, so that credentials contained in keys cannot be guessed from the stored keys
+func (c *encryptedCache) key(key string) string {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *encryptedCache) Get(key string) ([]byte, bool) {
+	data, found := c.cache.Get(c.key(key))
+	if !found {
+		return nil, false
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize {
+		util.LogWarning("Ignoring malformed encrypted cache entry")
+		return nil, false
+	}
+	// the key is authenticated as well, so that entries cannot be moved to other keys
+	value, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(key))
+	if err != nil {
+		util.LogWarning("Ignoring cache entry that could not be decrypted: %v", err)
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *encryptedCache) Set(key string, value []byte, ttl time.Duration) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		util.LogWarning("Unable to encrypt cache entry: %v", err)
+		return
+	}
+	c.cache.Set(c.key(key), c.aead.Seal(nonce, nonce, value, []byte(key)), ttl)
+}
+
+func (c *encryptedCache) Delete(key string) {
+	c.cache.Delete(c.key(key))
+}
@@ -0,0 +1,83 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/sapcc/maia/pkg/util"
+)
+
+// maxRelativeExpiration is the longest expiration time (in seconds) that memcached treats as relative
+const maxRelativeExpiration = 30 * 24 * 3600
+
+// memcachedCache is a cache shared between processes via memcached
+type memcachedCache struct {
+	client    *memcache.Client
+	namespace string
+}
+
+// NewMemcachedCache creates a cache storing its entries on the given memcached servers (host:port). The namespace
+// separates the entries of different caches sharing the same servers.
+func NewMemcachedCache(namespace string, servers ...string) Cache {
+	return &memcachedCache{client: memcache.New(servers...), namespace: namespace}
+}
+
+// key maps keys to memcached keys. Hashing keeps them within the length and character restrictions of memcached
+// and avoids storing credentials in plain text.
+func (c *memcachedCache) key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "maia:" + c.namespace + ":" + hex.EncodeToString(sum[:])
+}
+
+func (c *memcachedCache) Get(key string) ([]byte, bool) {
+	item, err := c.client.Get(c.key(key))
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			util.LogWarning("memcached lookup failed: %v", err)
+		}
+		return nil, false
+	}
+	return item.Value, true
+}
+
+func (c *memcachedCache) Set(key string, value []byte, ttl time.Duration) {
+	// memcached expects seconds (0 = no expiry), so round up to not turn short TTLs into infinite ones
+	expiration := int64(0)
+	if ttl > 0 {
+		expiration = int64((ttl + time.Second - 1) / time.Second)
+	}
+	// longer periods are interpreted as Unix timestamps
+	if expiration > maxRelativeExpiration {
+		expiration += time.Now().Unix()
+	}
+	if err := c.client.Set(&memcache.Item{Key: c.key(key), Value: value, Expiration: int32(expiration)}); err != nil {
+		util.LogWarning("memcached update failed: %v", err)
+	}
+}
+
+func (c *memcachedCache) Delete(key string) {
+	if err := c.client.Delete(c.key(key)); err != nil && err != memcache.ErrCacheMiss {
+		util.LogWarning("memcached delete failed: %v", err)
+	}
+}
@@ -20,19 +20,25 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"github.com/sapcc/maia/pkg/keystone"
 	"github.com/sapcc/maia/pkg/storage"
 	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -41,8 +47,17 @@ import (
 const (
 	timestampKey = "__timestamp__"
 	valueKey     = "__value__"
+	countKey     = "__count__"
+	sumKey       = "__sum__"
+	quantileKey  = "__quantile__"
 )
 
+// histogramQuantiles are displayed instead of the buckets of native histograms
+var histogramQuantiles = []struct {
+	key string
+	q   float64
+}{{"__p50__", 0.5}, {"__p90__", 0.9}, {"__p99__", 0.99}}
+
 var maiaURL string
 var selector string
 var auth tokens.AuthOptions
@@ -53,9 +68,12 @@ var columns string
 var separator string
 var starttime, endtime, timestamp string
 var timeout, stepsize time.Duration
+var explain bool
+var limit int
 
 var keystoneDriver keystone.Driver
 var storageDriver storage.Driver
+var maiaDriver storage.MaiaClient
 var tzLocation = time.Local
 
 // recoverAll is used to turn panics into error output
@@ -80,11 +98,11 @@ func fetchToken() {
 	if (auth.Username == "" && auth.UserID == "") || auth.Password == "" {
 		panic(fmt.Errorf("You must at least specify --os-username / --os-user-id and --os-password"))
 	}
-	context, url, err := keystoneInstance().Authenticate(&auth)
+	authContext, url, err := keystoneInstance().Authenticate(&auth)
 	if err != nil {
 		panic(err)
 	}
-	auth.TokenID = context.Auth["token"]
+	auth.TokenID = authContext.Auth["token"]
 	if maiaURL == "" {
 		maiaURL = url
 	}
@@ -106,6 +124,23 @@ func storageInstance() storage.Driver {
 	return storageDriver
 }
 
+// maiaInstance returns the client for the APIs which only Maia offers, so Prometheus cannot be used directly
+func maiaInstance() storage.MaiaClient {
+	if maiaDriver == nil {
+		if promURL != "" {
+			panic(fmt.Errorf("This command is only supported by Maia, not by Prometheus (--prometheus-url)"))
+		} else if auth.IdentityEndpoint != "" {
+			// authenticate and set maiaURL if missing
+			fetchToken()
+			maiaDriver = storage.NewMaiaClient(maiaURL, map[string]string{"X-Auth-Token": auth.TokenID})
+		} else {
+			panic(fmt.Errorf("--os-auth-url needs to be specified (or OS_AUTH_URL)"))
+		}
+	}
+
+	return maiaDriver
+}
+
 func keystoneInstance() keystone.Driver {
 	if keystoneDriver == nil {
 		setKeystoneInstance(keystone.NewKeystoneDriver())
@@ -118,7 +153,7 @@ func printValues(resp *http.Response) {
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(fmt.Errorf("Server responsed with error code %d: %s", resp.StatusCode, err.Error()))
+		panic(fmt.Errorf("Server responded with error code %d: %s", resp.StatusCode, err.Error()))
 	} else {
 		contentType := resp.Header.Get("Content-Type")
 		if contentType == storage.JSON {
@@ -151,12 +186,49 @@ func printValues(resp *http.Response) {
 	}
 }
 
+// printOpenMetrics prints federated metrics in the OpenMetrics format. Responses of servers which cannot produce
+// OpenMetrics themselves (e.g. plain Prometheus) are converted.
+func printOpenMetrics(resp *http.Response) {
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/openmetrics-text") {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	format := expfmt.ResponseFormat(resp.Header)
+	if format == expfmt.FmtUnknown {
+		panic(fmt.Errorf("Unsupported response type from server: %s", contentType))
+	}
+	decoder := expfmt.NewDecoder(resp.Body, format)
+	encoder := expfmt.NewEncoder(os.Stdout, expfmt.FmtOpenMetrics_1_0_0)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		if err := encoder.Encode(mf); err != nil {
+			panic(err)
+		}
+	}
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
 func printTable(resp *http.Response) {
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Server responsed with error code %d: %s", resp.StatusCode, err.Error())
+		fmt.Printf("Server responded with error code %d: %s", resp.StatusCode, err.Error())
 	} else {
 		contentType := resp.Header.Get("Content-Type")
 		if contentType == storage.JSON {
@@ -289,6 +361,24 @@ func timeColumnFromTS(ts time.Time) string {
 	return ts.Truncate(stepsize).In(tzLocation).Format(time.RFC3339)
 }
 
+// histogramQuantile estimates a quantile of a native histogram by linear interpolation within the bucket containing
+// it (like histogram_quantile() does for classic histograms)
+func histogramQuantile(q float64, h *model.SampleHistogram) model.SampleValue {
+	if h.Count == 0 || len(h.Buckets) == 0 {
+		return model.SampleValue(math.NaN())
+	}
+	rank := q * float64(h.Count)
+	var cumulative float64
+	for _, b := range h.Buckets {
+		count := float64(b.Count)
+		if count > 0 && cumulative+count >= rank {
+			return model.SampleValue(float64(b.Lower) + (float64(b.Upper)-float64(b.Lower))*(rank-cumulative)/count)
+		}
+		cumulative += count
+	}
+	return model.SampleValue(h.Buckets[len(h.Buckets)-1].Upper)
+}
+
 func printQueryResultAsTable(body []byte) {
 	var queryResponse storage.QueryResponse
 	err := json.Unmarshal(body, &queryResponse)
@@ -307,6 +397,7 @@ func printQueryResultAsTable(body []byte) {
 		tsSet := map[string]bool{}
 		// if no columns have been specified by user then collect them all
 		set := buildColumnSet(matrix)
+		hasHistograms := false
 		for _, el := range matrix {
 			columnValues := map[string]string{}
 			for labelKey, labelValue := range el.Metric {
@@ -317,27 +408,74 @@ func printQueryResultAsTable(body []byte) {
 				tsSet[s] = true
 				columnValues[s] = value.Value.String()
 			}
-			rows = append(rows, columnValues)
+			if len(el.Values) > 0 || len(el.Histograms) == 0 {
+				rows = append(rows, columnValues)
+			}
+			// native histograms are displayed as one row per quantile
+			if len(el.Histograms) > 0 {
+				hasHistograms = true
+				for _, hq := range histogramQuantiles {
+					quantileValues := map[string]string{quantileKey: strconv.FormatFloat(hq.q, 'f', -1, 64)}
+					for labelKey, labelValue := range el.Metric {
+						quantileValues[string(labelKey)] = string(labelValue)
+					}
+					for _, pair := range el.Histograms {
+						s := timeColumnFromTS(pair.Timestamp.Time())
+						tsSet[s] = true
+						quantileValues[s] = histogramQuantile(hq.q, pair.Histogram).String()
+					}
+					rows = append(rows, quantileValues)
+				}
+			}
+		}
+		allColumns = makeColumns(set)
+		if hasHistograms {
+			allColumns = append(allColumns, quantileKey)
 		}
-		allColumns = append(makeColumns(set), makeColumns(tsSet)...)
+		allColumns = append(allColumns, makeColumns(tsSet)...)
 	case model.ValVector:
 		matrix := valueObject.(model.Vector)
 		set := buildColumnSet(matrix)
+		hasFloats, hasHistograms := false, false
 		for _, el := range matrix {
 			collectKeys(set, model.LabelSet(el.Metric))
 			columnValues := map[string]string{}
 			columnValues[timestampKey] = el.Timestamp.Time().In(tzLocation).Format(time.RFC3339Nano)
-			columnValues[valueKey] = el.Value.String()
+			if h := el.Histogram; h != nil {
+				// native histograms are displayed as count, sum and quantiles
+				hasHistograms = true
+				columnValues[countKey] = h.Count.String()
+				columnValues[sumKey] = h.Sum.String()
+				for _, hq := range histogramQuantiles {
+					columnValues[hq.key] = histogramQuantile(hq.q, h).String()
+				}
+			} else {
+				hasFloats = true
+				columnValues[valueKey] = el.Value.String()
+			}
 			for labelKey, labelValue := range el.Metric {
 				columnValues[string(labelKey)] = string(labelValue)
 			}
 			rows = append(rows, columnValues)
 		}
-		allColumns = append(makeColumns(set), []string{timestampKey, valueKey}...)
+		allColumns = append(makeColumns(set), timestampKey)
+		if hasFloats || !hasHistograms {
+			allColumns = append(allColumns, valueKey)
+		}
+		if hasHistograms {
+			allColumns = append(allColumns, countKey, sumKey)
+			for _, hq := range histogramQuantiles {
+				allColumns = append(allColumns, hq.key)
+			}
+		}
 	case model.ValScalar:
 		scalarValue := valueObject.(*model.Scalar)
 		allColumns = []string{timestampKey, valueKey}
 		rows = []map[string]string{{timestampKey: scalarValue.Timestamp.Time().In(tzLocation).Format(time.RFC3339Nano), valueKey: scalarValue.String()}}
+	case model.ValString:
+		stringValue := valueObject.(*model.String)
+		allColumns = []string{timestampKey, valueKey}
+		rows = []map[string]string{{timestampKey: stringValue.Timestamp.Time().In(tzLocation).Format(time.RFC3339Nano), valueKey: stringValue.Value}}
 	}
 	printHeader(allColumns)
 	for _, row := range rows {
@@ -345,30 +483,125 @@ func printQueryResultAsTable(body []byte) {
 	}
 }
 
-func printQueryResponse(resp *http.Response) {
+// printJSONResponse prints a JSON response of the Maia API in the selected --format. The table and value formats
+// are printed by printAsTable.
+func printJSONResponse(resp *http.Response, printAsTable func(body []byte)) {
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Server responsed with error code %d: %s", resp.StatusCode, err.Error())
+		fmt.Fprintf(os.Stderr, "Server responded with error code %d: %s", resp.StatusCode, err.Error())
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != storage.JSON {
+		util.LogWarning("Response body: %s", string(body))
+		panic(fmt.Errorf("Unsupported response type from server: %s", contentType))
+	}
+
+	if strings.EqualFold(outputFormat, "json") {
+		fmt.Print(string(body))
+	} else if strings.EqualFold(outputFormat, "template") {
+		if jsonTemplate == "" {
+			panic(fmt.Errorf("Missing --template parameter"))
+		}
+		printTemplate(body, jsonTemplate)
+	} else if strings.EqualFold(outputFormat, "table") || strings.EqualFold(outputFormat, "value") {
+		printAsTable(body)
 	} else {
-		contentType := resp.Header.Get("Content-Type")
-		if contentType == storage.JSON {
-			if strings.EqualFold(outputFormat, "json") {
-				fmt.Print(string(body))
-			} else if strings.EqualFold(outputFormat, "template") {
-				if jsonTemplate == "" {
-					panic(fmt.Errorf("Missing --template parameter"))
-				}
-				printTemplate(body, jsonTemplate)
-			} else if strings.EqualFold(outputFormat, "table") {
-				printQueryResultAsTable(body)
-			} else {
-				panic(fmt.Errorf("Unsupported --format value for this command: %s", outputFormat))
+		panic(fmt.Errorf("Unsupported --format value for this command: %s", outputFormat))
+	}
+}
+
+func printExemplarsAsTable(body []byte) {
+	var exemplarsResponse storage.ExemplarsResponse
+	if err := json.Unmarshal(body, &exemplarsResponse); err != nil {
+		panic(err)
+	}
+
+	// series labels first, then the labels of the exemplars (i.e. the trace IDs)
+	seriesSet, exemplarSet := map[string]bool{}, map[string]bool{}
+	rows := []map[string]string{}
+	for _, el := range exemplarsResponse.Data {
+		collectKeys(seriesSet, el.SeriesLabels)
+		for _, exemplar := range el.Exemplars {
+			collectKeys(exemplarSet, exemplar.Labels)
+			columnValues := map[string]string{}
+			for labelKey, labelValue := range el.SeriesLabels {
+				columnValues[string(labelKey)] = string(labelValue)
 			}
-		} else {
-			util.LogWarning("Response body: %s", string(body))
-			panic(fmt.Errorf("Unsupported response type from server: %s", contentType))
+			for labelKey, labelValue := range exemplar.Labels {
+				columnValues[string(labelKey)] = string(labelValue)
+			}
+			columnValues[timestampKey] = exemplar.Timestamp.Time().In(tzLocation).Format(time.RFC3339Nano)
+			columnValues[valueKey] = exemplar.Value.String()
+			rows = append(rows, columnValues)
+		}
+	}
+
+	var allColumns []string
+	if columns != "" {
+		allColumns = strings.Split(columns, ",")
+	} else {
+		allColumns = append(append(makeColumns(seriesSet), makeColumns(exemplarSet)...), timestampKey, valueKey)
+	}
+	printHeader(allColumns)
+	for _, row := range rows {
+		printRow(allColumns, row)
+	}
+}
+
+func printExplainAsTable(body []byte) {
+	var explainResponse storage.ExplainResponse
+	if err := json.Unmarshal(body, &explainResponse); err != nil {
+		panic(err)
+	}
+
+	data := explainResponse.Data
+	allColumns := []string{"field", "value"}
+	rows := []map[string]string{
+		{"field": "query", "value": data.Query},
+		{"field": "rewritten_query", "value": data.RewrittenQuery},
+	}
+	if data.Scope.ProjectID != "" {
+		rows = append(rows, map[string]string{"field": "project_id", "value": data.Scope.ProjectID})
+	}
+	if data.Scope.DomainID != "" {
+		rows = append(rows, map[string]string{"field": "domain_id", "value": data.Scope.DomainID})
+	}
+	if len(data.Scope.ChildProjects) > 0 {
+		rows = append(rows, map[string]string{"field": "child_projects", "value": strings.Join(data.Scope.ChildProjects, ",")})
+	}
+	for _, finding := range data.Findings {
+		rows = append(rows, map[string]string{"field": "finding", "value": finding})
+	}
+
+	printHeader(allColumns)
+	for _, row := range rows {
+		printRow(allColumns, row)
+	}
+}
+
+func printCardinalityAsTable(body []byte) {
+	var cardinalityResponse storage.CardinalityResponse
+	if err := json.Unmarshal(body, &cardinalityResponse); err != nil {
+		panic(err)
+	}
+
+	tables := []struct {
+		columns []string
+		entries []storage.CardinalityEntry
+	}{
+		{[]string{"metric", "series"}, cardinalityResponse.Data.SeriesCountByMetricName},
+		{[]string{"label", "values"}, cardinalityResponse.Data.LabelValueCountByLabelName},
+	}
+	for i, table := range tables {
+		if i > 0 {
+			fmt.Println()
+		}
+		printHeader(table.columns)
+		for _, entry := range table.entries {
+			printRow(table.columns, map[string]string{table.columns[0]: entry.Name, table.columns[1]: strconv.Itoa(entry.Value)})
 		}
 	}
 }
@@ -382,11 +615,20 @@ func Snapshot(cmd *cobra.Command, args []string) (ret error) {
 
 	prometheus := storageInstance()
 
+	acceptContentType := storage.PlainText
+	if strings.EqualFold(outputFormat, "openmetrics") {
+		acceptContentType = storage.OpenMetrics
+	}
+
 	var resp *http.Response
-	resp, err := prometheus.Federate([]string{"{" + selector + "}"}, storage.PlainText)
+	resp, err := prometheus.Federate(context.Background(), []string{"{" + selector + "}"}, acceptContentType)
 	checkResponse(err, resp)
 
-	printValues(resp)
+	if strings.EqualFold(outputFormat, "openmetrics") {
+		printOpenMetrics(resp)
+	} else {
+		printValues(resp)
+	}
 
 	return nil
 }
@@ -407,7 +649,7 @@ func LabelValues(cmd *cobra.Command, args []string) (ret error) {
 	prometheus := storageInstance()
 
 	var resp *http.Response
-	resp, err := prometheus.LabelValues(labelName, storage.JSON)
+	resp, err := prometheus.LabelValues(context.Background(), labelName, storage.JSON)
 	checkResponse(err, resp)
 
 	printValues(resp)
@@ -427,7 +669,7 @@ func Series(cmd *cobra.Command, args []string) (ret error) {
 	prometheus := storageInstance()
 
 	var resp *http.Response
-	resp, err := prometheus.Series([]string{"{" + selector + "}"}, starttime, endtime, storage.JSON)
+	resp, err := prometheus.Series(context.Background(), []string{"{" + selector + "}"}, starttime, endtime, storage.JSON)
 	checkResponse(err, resp)
 
 	printTable(resp)
@@ -478,6 +720,13 @@ func Query(cmd *cobra.Command, args []string) (ret error) {
 	}
 	queryExpr := args[0]
 
+	if explain {
+		resp, err := maiaInstance().Explain(context.Background(), queryExpr, storage.JSON)
+		checkResponse(err, resp)
+		printJSONResponse(resp, printExplainAsTable)
+		return nil
+	}
+
 	var timeoutStr, stepStr string
 	if timeout > 0 {
 		// workaround parsing issues
@@ -514,14 +763,62 @@ func Query(cmd *cobra.Command, args []string) (ret error) {
 			}
 			stepStr = fmt.Sprintf("%ds", int(sz.Seconds()))
 		}
-		resp, err = prometheus.QueryRange(queryExpr, starttime, endtime, stepStr, timeoutStr, storage.JSON)
+		resp, err = prometheus.QueryRange(context.Background(), queryExpr, starttime, endtime, stepStr, timeoutStr, storage.JSON)
 	} else {
-		resp, err = prometheus.Query(queryExpr, timestamp, timeoutStr, storage.JSON)
+		resp, err = prometheus.Query(context.Background(), queryExpr, timestamp, timeoutStr, storage.JSON)
+	}
+
+	checkResponse(err, resp)
+
+	printJSONResponse(resp, printQueryResultAsTable)
+
+	return nil
+}
+
+// Exemplars is just public because unit testing frameworks complains otherwise
+func Exemplars(cmd *cobra.Command, args []string) (ret error) {
+	// transform panics with error params into errors
+	defer recoverAll()
+
+	setDefaultOutputFormat("table")
+
+	// check parameters
+	if len(args) < 1 {
+		return fmt.Errorf("missing argument: PromQL Query")
 	}
+	queryExpr := args[0]
+	starttime, endtime = defaultTimeRangeStr(starttime, endtime)
+
+	prometheus := storageInstance()
 
+	var resp *http.Response
+	resp, err := prometheus.QueryExemplars(context.Background(), queryExpr, starttime, endtime, storage.JSON)
 	checkResponse(err, resp)
 
-	printQueryResponse(resp)
+	printJSONResponse(resp, printExemplarsAsTable)
+
+	return nil
+}
+
+// Cardinality is just public because unit testing frameworks complains otherwise
+func Cardinality(cmd *cobra.Command, args []string) (ret error) {
+	// transform panics with error params into errors
+	defer recoverAll()
+
+	setDefaultOutputFormat("table")
+
+	var limitStr string
+	if limit > 0 {
+		limitStr = strconv.Itoa(limit)
+	}
+
+	maia := maiaInstance()
+
+	var resp *http.Response
+	resp, err := maia.Cardinality(context.Background(), limitStr, storage.JSON)
+	checkResponse(err, resp)
+
+	printJSONResponse(resp, printCardinalityAsTable)
 
 	return nil
 }
@@ -570,18 +867,34 @@ var metricNamesCmd = &cobra.Command{
 }
 
 var queryCmd = &cobra.Command{
-	Use:   "query <PromQL Query> [ --time | [ --start <starttime> ] [ --end <endtime> ] [ --step <duration> ] ] [ --timeout <duration> ]",
+	Use:   "query <PromQL Query> [ --time | [ --start <starttime> ] [ --end <endtime> ] [ --step <duration> ] ] [ --timeout <duration> ] [ --explain ]",
 	Short: "Perform a PromQL Query",
 	Long:  "Performs a PromQL query against the metrics available for the project/domain in scope",
 	RunE:  Query,
 }
 
+var exemplarsCmd = &cobra.Command{
+	Use:   "exemplars <PromQL Query> [ --start <starttime> ] [ --end <endtime> ]",
+	Short: "List exemplars (e.g. trace IDs) of a PromQL Query",
+	Long:  "Lists the exemplars recorded for the Series selected by a PromQL query, e.g. to find traces of slow requests",
+	RunE:  Exemplars,
+}
+
+var cardinalityCmd = &cobra.Command{
+	Use:   "cardinality [ --limit <n> ]",
+	Short: "Show the metrics and labels with the most Series for project/domain.",
+	Long:  "Lists the metric names with the highest number of Series and the labels with the highest number of distinct values (Maia only). This helps to find the cause of slow queries.",
+	RunE:  Cardinality,
+}
+
 func init() {
 	RootCmd.AddCommand(snapshotCmd)
 	RootCmd.AddCommand(queryCmd)
+	RootCmd.AddCommand(exemplarsCmd)
 	RootCmd.AddCommand(seriesCmd)
 	RootCmd.AddCommand(labelValuesCmd)
 	RootCmd.AddCommand(metricNamesCmd)
+	RootCmd.AddCommand(cardinalityCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -606,7 +919,7 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&auth.Scope.DomainID, "os-domain-id", os.Getenv("OS_DOMAIN_ID"), "OpenStack domain ID to scope to")
 	RootCmd.PersistentFlags().StringVar(&auth.TokenID, "os-token", os.Getenv("OS_TOKEN"), "OpenStack keystone token")
 
-	RootCmd.PersistentFlags().StringVarP(&outputFormat, "format", "f", "", "Specify output format: table, json, template or value")
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "format", "f", "", "Specify output format: table, json, template, value or openmetrics (snapshot only)")
 	RootCmd.PersistentFlags().StringVarP(&columns, "columns", "c", "", "Specify the columns to print (comma-separated; only when --format value is set)")
 	RootCmd.PersistentFlags().StringVar(&separator, "separator", " ", "Separate different columns with this string (only when --columns value is set; default <space>)")
 	RootCmd.PersistentFlags().StringVar(&jsonTemplate, "template", "", "Go-template to define a custom output format based on the JSON response (only when --format=template)")
@@ -621,8 +934,14 @@ func init() {
 	queryCmd.Flags().StringVar(&endtime, "end", "", "Range query: end timestamp (RFC3339 or Unix format; default: now)")
 	queryCmd.Flags().StringVar(&timestamp, "time", "", "Instant query: timestamp of measurement (RFC3339 or Unix format; default: now)")
 	queryCmd.Flags().DurationVarP(&timeout, "timeout", "", 0, "Optional: Timeout for Query (e.g. 10m; default: server setting)")
+	queryCmd.Flags().BoolVar(&explain, "explain", false, "Show how the Query is restricted to the project/domain instead of executing it (Maia only)")
 	queryCmd.Flags().DurationVarP(&stepsize, "step", "", 0, "Optional: Step size for range Query (e.g. 30s; default: sized to display 12 values)")
 
+	exemplarsCmd.Flags().StringVar(&starttime, "start", "", "Start timestamp (RFC3339 or Unix format; default: 3h before)")
+	exemplarsCmd.Flags().StringVar(&endtime, "end", "", "End timestamp (RFC3339 or Unix format; default: now)")
+
+	cardinalityCmd.Flags().IntVar(&limit, "limit", 0, "Number of metrics and labels to list (default: server setting)")
+
 	seriesCmd.Flags().StringVarP(&selector, "selector", "l", "", "Prometheus label-selector to restrict the amount of metrics")
 	seriesCmd.Flags().StringVar(&starttime, "start", "", "Start timestamp (RFC3339 or Unix format; default: 3h before)")
 	seriesCmd.Flags().StringVar(&endtime, "end", "", "End timestamp (RFC3339 or Unix format; default: now)")
@@ -635,3 +954,7 @@ func setKeystoneInstance(keystone keystone.Driver) {
 func setStorageInstance(storage storage.Driver) {
 	storageDriver = storage
 }
+
+func setMaiaInstance(maia storage.MaiaClient) {
+	maiaDriver = maia
+}
@@ -35,11 +35,11 @@ type testReporter struct {
 }
 
 func (r testReporter) Errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args))
+	panic(fmt.Errorf(format, args...))
 }
 
 func (r testReporter) Fatalf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args))
+	panic(fmt.Errorf(format, args...))
 }
 
 func setupTest(controller *gomock.Controller) (*keystone.MockDriver, *storage.MockDriver) {
@@ -51,6 +51,8 @@ func setupTest(controller *gomock.Controller) (*keystone.MockDriver, *storage.Mo
 	starttime = ""
 	endtime = ""
 	stepsize = 0
+	explain = false
+	limit = 0
 	columns = ""
 
 	// create dummy keystone and storage mock
@@ -60,10 +62,18 @@ func setupTest(controller *gomock.Controller) (*keystone.MockDriver, *storage.Mo
 
 	setKeystoneInstance(keystone)
 	setStorageInstance(storage)
+	setMaiaInstance(nil)
 
 	return keystone, storage
 }
 
+// setupMaiaTest installs a mock for the APIs which only Maia offers
+func setupMaiaTest(controller *gomock.Controller) *storage.MockMaiaClient {
+	maia := storage.NewMockMaiaClient(controller)
+	setMaiaInstance(maia)
+	return maia
+}
+
 func expectAuth(keystoneMock *keystone.MockDriver) {
 	keystoneMock.EXPECT().Authenticate(&tokens.AuthOptions{UserID: "user_id", Password: "testwd", Scope: tokens.Scope{ProjectID: "12345"}}).Return(&policy.Context{Request: map[string]string{"user_id": "testuser",
 		"project_id": "12345", "password": "testwd"}, Auth: map[string]string{"project_id": "12345"}, Roles: []string{"monitoring_viewer"}}, "http://localhost:9091", nil)
@@ -87,7 +97,7 @@ func ExampleSnapshot() {
 	selector = "vmware_name=\"win_cifs_13\""
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().Federate([]string{"{" + selector + "}"}, storage.PlainText).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{" + selector + "}"}, storage.PlainText).Return(test.HTTPResponseFromFile("fixtures/federate.txt"), nil)
 
 	snapshotCmd.RunE(snapshotCmd, []string{})
 	// Output:
@@ -95,6 +105,27 @@ func ExampleSnapshot() {
 	// vcenter_cpu_costop_summation{component="vcenter-exporter-vc-a-0",instance="100.65.0.252:9102",instance_uuid="3b32f415-c953-40b9-883d-51321611a7d4",job="endpoints",kubernetes_name="vcenter-exporter-vc-a-0",kubernetes_namespace="maia",metric_detail="3",project_id="12345",region="staging",service="metrics",system="openstack",vcenter_name="STAGINGA",vcenter_node="10.44.2.40",vmware_name="win_cifs_13"} 0 1500291187275
 }
 
+func ExampleSnapshot_openMetrics() {
+	t := testReporter{}
+	ctrl := gomock.NewController(&t)
+	defer ctrl.Finish()
+
+	keystoneMock, storageMock := setupTest(ctrl)
+
+	outputFormat = "openmetrics"
+	selector = "vmware_name=\"win_cifs_13\""
+
+	expectAuth(keystoneMock)
+	// the server responds with the text format, so the client converts
+	storageMock.EXPECT().Federate(gomock.Any(), []string{"{" + selector + "}"}, storage.OpenMetrics).Return(test.HTTPResponseFromFile("fixtures/federate_text.txt"), nil)
+
+	snapshotCmd.RunE(snapshotCmd, []string{})
+	// Output:
+	// # TYPE vcenter_cpu_costop_summation unknown
+	// vcenter_cpu_costop_summation{component="vcenter-exporter-vc-a-0",instance="100.65.0.252:9102",instance_uuid="3b32f415-c953-40b9-883d-51321611a7d4",job="endpoints",kubernetes_name="vcenter-exporter-vc-a-0",kubernetes_namespace="maia",metric_detail="3",project_id="12345",region="staging",service="metrics",system="openstack",vcenter_name="STAGINGA",vcenter_node="10.44.2.40",vmware_name="win_cifs_13"} 0.0 1.500291187275e+09
+	// # EOF
+}
+
 func ExampleSeries_json() {
 	t := testReporter{}
 	ctrl := gomock.NewController(t)
@@ -108,7 +139,7 @@ func ExampleSeries_json() {
 	outputFormat = "jsoN"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().Series([]string{"{" + selector + "}"}, starttime, endtime, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{" + selector + "}"}, starttime, endtime, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
 	seriesCmd.RunE(seriesCmd, []string{})
 
@@ -144,7 +175,7 @@ func ExampleSeries_table() {
 	outputFormat = "table"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().Series([]string{"{" + selector + "}"}, starttime, endtime, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
+	storageMock.EXPECT().Series(gomock.Any(), []string{"{" + selector + "}"}, starttime, endtime, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/series.json"), nil)
 
 	seriesCmd.RunE(seriesCmd, []string{})
 
@@ -164,7 +195,7 @@ func ExampleLabelValues_json() {
 	outputFormat = "jSon"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().LabelValues(labelName, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/label_values.json"), nil)
+	storageMock.EXPECT().LabelValues(gomock.Any(), labelName, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/label_values.json"), nil)
 
 	labelValuesCmd.RunE(labelValuesCmd, []string{labelName})
 
@@ -188,7 +219,7 @@ func ExampleLabelValues_values() {
 	outputFormat = "VaLue"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().LabelValues(labelName, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/label_values.json"), nil)
+	storageMock.EXPECT().LabelValues(gomock.Any(), labelName, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/label_values.json"), nil)
 
 	labelValuesCmd.RunE(labelValuesCmd, []string{labelName})
 
@@ -207,7 +238,7 @@ func ExampleMetricNames_values() {
 	outputFormat = "valuE"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().LabelValues("__name__", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/metric_names.json"), nil)
+	storageMock.EXPECT().LabelValues(gomock.Any(), "__name__", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/metric_names.json"), nil)
 
 	metricNamesCmd.RunE(metricNamesCmd, []string{})
 
@@ -232,7 +263,7 @@ func ExampleQuery_json() {
 	outputFormat = "jsoN"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().Query(query, timestamp, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+	storageMock.EXPECT().Query(gomock.Any(), query, timestamp, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
 
 	queryCmd.RunE(queryCmd, []string{query})
 
@@ -268,7 +299,7 @@ func ExampleQuery_table() {
 	outputFormat = "TaBle"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().Query(query, timestamp, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
+	storageMock.EXPECT().Query(gomock.Any(), query, timestamp, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query.json"), nil)
 
 	queryCmd.RunE(queryCmd, []string{query})
 
@@ -277,6 +308,34 @@ func ExampleQuery_table() {
 	// 2017-07-03T07:26:23.997Z 0
 }
 
+func ExampleQuery_explain() {
+	t := testReporter{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	keystoneMock, _ := setupTest(ctrl)
+	maiaMock := setupMaiaTest(ctrl)
+
+	query := "sum(rate(http_requests_total{job=\"api\"}[7d]))"
+	outputFormat = "table"
+	separator = " | "
+	defer func() { separator = " " }()
+	explain = true
+
+	expectAuth(keystoneMock)
+	maiaMock.EXPECT().Explain(gomock.Any(), query, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/explain.json"), nil)
+
+	queryCmd.RunE(queryCmd, []string{query})
+
+	// Output:
+	// field | value
+	// query | sum(rate(http_requests_total{job="api"}[7d]))
+	// rewritten_query | sum(rate(http_requests_total{job="api",project_id=~"12345|67890"}[1w]))
+	// project_id | 12345
+	// child_projects | 67890
+	// finding | http_requests_total{job="api"}[1w] reads 1w of samples per series, consider a shorter range or a recording rule
+}
+
 func ExampleQuery_rangeJSON() {
 	t := testReporter{}
 	ctrl := gomock.NewController(t)
@@ -294,7 +353,7 @@ func ExampleQuery_rangeJSON() {
 	outputFormat = "jsoN"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().QueryRange(query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_values.json"), nil)
+	storageMock.EXPECT().QueryRange(gomock.Any(), query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_values.json"), nil)
 
 	queryCmd.RunE(queryCmd, []string{query})
 
@@ -339,7 +398,7 @@ func ExampleQuery_rangeValuesTable() {
 	outputFormat = "tablE"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().QueryRange(query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_values.json"), nil)
+	storageMock.EXPECT().QueryRange(gomock.Any(), query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_values.json"), nil)
 
 	queryCmd.RunE(queryCmd, []string{query})
 
@@ -348,6 +407,57 @@ func ExampleQuery_rangeValuesTable() {
 	// 0 1
 }
 
+func ExampleQuery_histogramTable() {
+	t := testReporter{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	keystoneMock, storageMock := setupTest(ctrl)
+
+	timestamp = "2017-07-03T07:26:23.997Z"
+	timeoutStr := "1440s"
+	timeout, _ = time.ParseDuration(timeoutStr)
+	query := "request_duration_seconds"
+	outputFormat = "table"
+
+	expectAuth(keystoneMock)
+	storageMock.EXPECT().Query(gomock.Any(), query, timestamp, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_histogram.json"), nil)
+
+	queryCmd.RunE(queryCmd, []string{query})
+
+	// Output:
+	// __name__ __timestamp__ __count__ __sum__ __p50__ __p90__ __p99__
+	// request_duration_seconds 2017-07-03T07:26:23.997Z 4 3.5 1 1.8 1.98
+}
+
+func ExampleQuery_rangeHistogramTable() {
+	t := testReporter{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	keystoneMock, storageMock := setupTest(ctrl)
+
+	starttime = "2017-07-13T20:10:30.000Z"
+	endtime = "2017-07-13T20:15:00.000Z"
+	stepsizeStr := "300s"
+	stepsize, _ = time.ParseDuration(stepsizeStr)
+	timeoutStr := "90s"
+	timeout, _ = time.ParseDuration(timeoutStr)
+	query := "request_duration_seconds"
+	outputFormat = "table"
+
+	expectAuth(keystoneMock)
+	storageMock.EXPECT().QueryRange(gomock.Any(), query, starttime, endtime, stepsizeStr, timeoutStr, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_range_histogram.json"), nil)
+
+	queryCmd.RunE(queryCmd, []string{query})
+
+	// Output:
+	// __name__ __quantile__ 2017-07-13T20:10:00Z 2017-07-13T20:15:00Z
+	// request_duration_seconds 0.5 1 0.5
+	// request_duration_seconds 0.9 1.8 0.9
+	// request_duration_seconds 0.99 1.98 0.99
+}
+
 func ExampleQuery_rangeSeriesTable() {
 	t := testReporter{}
 	ctrl := gomock.NewController(t)
@@ -366,7 +476,7 @@ func ExampleQuery_rangeSeriesTable() {
 	columns = "region,check,instance"
 
 	expectAuth(keystoneMock)
-	storageMock.EXPECT().QueryRange(query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_series.json"), nil)
+	storageMock.EXPECT().QueryRange(gomock.Any(), query, starttime, endtime, stepsizeStr, timeoutStr, "application/json").Return(test.HTTPResponseFromFile("fixtures/query_range_series.json"), nil)
 
 	queryCmd.RunE(queryCmd, []string{query})
 
@@ -374,3 +484,51 @@ func ExampleQuery_rangeSeriesTable() {
 	// check instance region 2017-07-22T20:10:00Z 2017-07-22T20:15:00Z 2017-07-22T20:20:00Z
 	// keystone 100.64.0.102:9102 staging 0 1 0
 }
+
+func ExampleExemplars_table() {
+	t := testReporter{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	keystoneMock, storageMock := setupTest(ctrl)
+
+	starttime = "2017-07-03T07:26:00Z"
+	endtime = "2017-07-03T07:27:00Z"
+	query := "http_request_duration_seconds_bucket"
+	columns = "le,trace_id,__timestamp__,__value__"
+
+	expectAuth(keystoneMock)
+	storageMock.EXPECT().QueryExemplars(gomock.Any(), query, starttime, endtime, storage.JSON).Return(test.HTTPResponseFromFile("fixtures/query_exemplars.json"), nil)
+
+	exemplarsCmd.RunE(exemplarsCmd, []string{query})
+
+	// Output:
+	// le trace_id __timestamp__ __value__
+	// 0.5 4bf92f3577b34da6a3ce929d0e0e4736 2017-07-03T07:26:23.997Z 0.27
+	// 0.5 00f067aa0ba902b7a3ce929d0e0e4736 2017-07-03T07:26:53.997Z 0.41
+}
+
+func ExampleCardinality_table() {
+	t := testReporter{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	keystoneMock, _ := setupTest(ctrl)
+	maiaMock := setupMaiaTest(ctrl)
+
+	limit = 2
+
+	expectAuth(keystoneMock)
+	maiaMock.EXPECT().Cardinality(gomock.Any(), "2", storage.JSON).Return(test.HTTPResponseFromFile("fixtures/cardinality.json"), nil)
+
+	cardinalityCmd.RunE(cardinalityCmd, []string{})
+
+	// Output:
+	// metric series
+	// http_requests_total 3
+	// up 2
+	//
+	// label values
+	// __name__ 3
+	// code 2
+}
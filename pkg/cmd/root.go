@@ -54,9 +54,40 @@ func setDefaultConfig() {
 	viper.SetDefault("maia.auth_driver", "keystone")
 	viper.SetDefault("maia.storage_driver", "prometheus")
 	viper.SetDefault("maia.label_value_ttl", "1h")
+	viper.SetDefault("maia.domain_scope_includes_projects", false)
+	viper.SetDefault("maia.multi_project_queries", false)
+	viper.SetDefault("maia.status_flags", "query.lookback-delta,query.max-concurrency,query.max-samples,query.timeout,storage.tsdb.retention,storage.tsdb.retention.time")
+	viper.SetDefault("maia.tenant_metrics", false)
+	viper.SetDefault("maia.federate_max_series", 50000)
+	viper.SetDefault("maia.cardinality_limit", 10)
+	viper.SetDefault("maia.cardinality_max_limit", 100)
+	viper.SetDefault("maia.cardinality_cache_ttl", "5m")
+	viper.SetDefault("maia.cardinality_max_series", 50000)
+	viper.SetDefault("maia.readiness_check_interval", "10s")
+	viper.SetDefault("maia.shutdown_timeout", "30s")
+	viper.SetDefault("maia.prometheus_connect_timeout", "5s")
+	viper.SetDefault("maia.prometheus_response_timeout", "150s")
+	viper.SetDefault("maia.prometheus_max_idle_conns", 20)
+	viper.SetDefault("maia.prometheus_retries", 2)
+	viper.SetDefault("maia.prometheus_retry_backoff", "200ms")
+	viper.SetDefault("maia.prometheus_breaker_threshold", 5)
+	viper.SetDefault("maia.prometheus_breaker_cooldown", "30s")
 	viper.SetDefault("keystone.token_cache_time", "900s")
+	viper.SetDefault("keystone.revocation_poll_interval", "60s")
+	viper.SetDefault("keystone.cache_backend", "memory")
+	viper.SetDefault("keystone.project_tree_concurrency", 8)
+	viper.SetDefault("keystone.project_tree_refresh_interval", "5m")
+	viper.SetDefault("keystone.project_tree_timeout", "60s")
 	viper.SetDefault("keystone.roles", "monitoring_viewer,monitoring_admin")
+	viper.SetDefault("keystone.show_all_rule", "metric:show_all")
 	viper.SetDefault("keystone.default_user_domain_name", "Default")
+	viper.SetDefault("audit.backpressure", "drop")
+	viper.SetDefault("audit.buffer_size", 1000)
+	viper.SetDefault("audit.batch_size", 100)
+	viper.SetDefault("audit.flush_interval", "5s")
+	viper.SetDefault("audit.max_retries", 3)
+	viper.SetDefault("audit.retry_interval", "1s")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
 }
 
 func init() {
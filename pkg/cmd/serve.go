@@ -22,6 +22,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/sapcc/maia/pkg/api"
+	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
@@ -51,6 +52,10 @@ var serveCmd = &cobra.Command{
 		}
 
 		readConfig(configFile)
+
+		if err := util.SetLogFormat(viper.GetString("maia.log_format")); err != nil {
+			panic(err)
+		}
 	},
 }
 
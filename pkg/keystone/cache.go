@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keystone
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/maia/pkg/cache"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// newCache creates the cache for one kind of Keystone lookups as configured by keystone.cache_backend
+func newCache(name string) cache.Cache {
+	switch backend := viper.GetString("keystone.cache_backend"); backend {
+	case "", "memory":
+		return cache.NewMemoryCache()
+	case "memcached":
+		servers := []string{}
+		for _, s := range strings.Split(viper.GetString("keystone.memcached_servers"), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				servers = append(servers, s)
+			}
+		}
+		if len(servers) == 0 {
+			panic(fmt.Errorf("keystone.cache_backend memcached requires keystone.memcached_servers"))
+		}
+		// the caches contain tokens, so entries in shared caches are encrypted
+		secret := viper.GetString("keystone.memcache_secret_key")
+		if secret == "" {
+			panic(fmt.Errorf("keystone.cache_backend memcached requires keystone.memcache_secret_key"))
+		}
+		return cache.NewEncryptedCache(cache.NewMemcachedCache(name, servers...), secret)
+	default:
+		panic(fmt.Errorf("unsupported keystone.cache_backend: %s", backend))
+	}
+}
+
+// cachedValue wraps values stored in the caches. Since shared caches cannot be enumerated, entries are invalidated
+// by recording the generations of the users and projects they depend on. FlushCache increments the generation.
+// Generations can be evicted from shared caches just like any other entry, so a missing generation invalidates every
+// entry depending on it.
+type cachedValue struct {
+	Generations map[string]string `json:"generations"`
+	Value       json.RawMessage   `json:"value"`
+}
+
+// generation returns the current generation of a user ("user/<id>") or of all projects ("projects"), or "" if
+// there is none (anymore)
+func (d *keystone) generation(key string) string {
+	gen, _ := d.generationCache.Get(key)
+	return string(gen)
+}
+
+// invalidate starts a new generation, which invalidates all cache entries depending on the key
+func (d *keystone) invalidate(key string) string {
+	gen := strconv.FormatInt(time.Now().UnixNano(), 10)
+	d.generationCache.Set(key, []byte(gen), 0)
+	return gen
+}
+
+// getCached looks up a cached value and deserializes it into value. Entries of an outdated generation are removed.
+func (d *keystone) getCached(c cache.Cache, key string, value interface{}) bool {
+	data, found := c.Get(key)
+	if !found {
+		return false
+	}
+	var cv cachedValue
+	if err := json.Unmarshal(data, &cv); err != nil {
+		util.LogWarning("Ignoring malformed cache entry: %v", err)
+		c.Delete(key)
+		return false
+	}
+	for genKey, gen := range cv.Generations {
+		if current := d.generation(genKey); current == "" || current != gen {
+			c.Delete(key)
+			return false
+		}
+	}
+	if err := json.Unmarshal(cv.Value, value); err != nil {
+		util.LogWarning("Ignoring malformed cache entry: %v", err)
+		c.Delete(key)
+		return false
+	}
+	return true
+}
+
+// setCached stores a value together with the current generations of the keys it depends on
+func (d *keystone) setCached(c cache.Cache, key string, value interface{}, ttl time.Duration, genKeys ...string) {
+	cv := cachedValue{Generations: make(map[string]string, len(genKeys))}
+	for _, genKey := range genKeys {
+		gen := d.generation(genKey)
+		if gen == "" {
+			// entries of the evicted generation must not become valid again
+			gen = d.invalidate(genKey)
+		}
+		cv.Generations[genKey] = gen
+	}
+	var err error
+	if cv.Value, err = json.Marshal(value); err == nil {
+		var data []byte
+		if data, err = json.Marshal(cv); err == nil {
+			c.Set(key, data, ttl)
+			return
+		}
+	}
+	util.LogWarning("Unable to cache value: %v", err)
+}
@@ -20,6 +20,7 @@
 package keystone
 
 import (
+	"context"
 	"fmt"
 	policy "github.com/databus23/goslo.policy"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
@@ -84,14 +85,23 @@ type Driver interface {
 	Authenticate(options *tokens.AuthOptions) (*policy.Context, string, AuthenticationError)
 
 	// ChildProjects returns the IDs of all child-projects of the project denoted by projectID
-	ChildProjects(projectID string) ([]string, error)
+	ChildProjects(ctx context.Context, projectID string) ([]string, error)
+
+	// DomainProjects returns the IDs of all projects in the domain denoted by domainID
+	DomainProjects(ctx context.Context, domainID string) ([]string, error)
 
 	// UserProjects returns the project IDs and name of all projects where the current user has a monitoring role
-	UserProjects(userID string) ([]tokens.Scope, error)
+	UserProjects(ctx context.Context, userID string) ([]tokens.Scope, error)
 
 	// ServiceURL returns the service's global catalog entry
 	// The result is empty when called from a client
 	ServiceURL() string
+
+	// HealthCheck verifies that the identity service is reachable and the service user's token is valid
+	HealthCheck() error
+
+	// FlushCache removes cached tokens, project trees and role assignments of the given user and/or project
+	FlushCache(userID, projectID string)
 }
 
 // NewKeystoneDriver is a factory method which chooses the right driver implementation based on configuration settings
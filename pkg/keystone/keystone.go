@@ -20,6 +20,7 @@
 package keystone
 
 import (
+	"context"
 	"fmt"
 
 	"net/http"
@@ -34,7 +35,8 @@ import (
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/users"
 	"github.com/gophercloud/gophercloud/pagination"
-	"github.com/patrickmn/go-cache"
+	"github.com/sapcc/maia/pkg/cache"
+	"github.com/sapcc/maia/pkg/tracing"
 	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/viper"
 	"math"
@@ -55,10 +57,20 @@ type keystone struct {
 	// these locks are used to make sure the connection or token is altered while somebody is working on it
 	serviceConnMutex, serviceTokenMutex *sync.Mutex
 	// these caches are thread-safe, no need to lock because worst-case is duplicate processing efforts
-	tokenCache, projectTreeCache, userProjectsCache, userIDCache *cache.Cache
-	providerClient                                               *gophercloud.ServiceClient
-	seqErrors                                                    int
-	serviceURL                                                   string
+	tokenCache, projectTreeCache, projectCache, userProjectsCache, userIDCache, generationCache cache.Cache
+	providerClient                                                                              *gophercloud.ServiceClient
+	seqErrors                                                                                   int
+	serviceURL                                                                                  string
+	// revocation events of the recent past, used to filter cached tokens
+	revocationEvents []recentRevocationEvent
+	revocationMutex  sync.RWMutex
+	// project trees being fetched (to share the result), the last time a tree has been requested and the domains
+	// whose disabled projects are cached
+	treeFetches     map[string]*treeFetch
+	treeUsage       map[string]time.Time
+	disabledDomains map[string]bool
+	treeMutex       sync.Mutex
+	noSubtreeAsIDs  int32
 	// role-id --> role-name
 	monitoringRoles map[string]string
 	// domain-id --> domain-name
@@ -68,18 +80,29 @@ type keystone struct {
 }
 
 func (d *keystone) init() {
-	d.tokenCache = cache.New(viper.GetDuration("keystone.token_cache_time"), time.Minute)
-	d.projectTreeCache = cache.New(viper.GetDuration("keystone.token_cache_time"), time.Minute)
-	d.userProjectsCache = cache.New(viper.GetDuration("keystone.token_cache_time"), time.Minute)
-	d.userIDCache = cache.New(cache.NoExpiration, time.Minute)
+	d.tokenCache = newCache("token")
+	d.projectTreeCache = newCache("tree")
+	d.projectCache = newCache("project")
+	d.userProjectsCache = newCache("userprojects")
+	d.userIDCache = newCache("userid")
+	d.generationCache = newCache("generation")
 	d.serviceConnMutex = &sync.Mutex{}
 	d.serviceTokenMutex = &sync.Mutex{}
+	d.treeFetches = map[string]*treeFetch{}
+	d.treeUsage = map[string]time.Time{}
+	d.disabledDomains = map[string]bool{}
 	if viper.Get("keystone.username") != nil {
 		// force service logon
 		_, err := d.serviceKeystoneClient()
 		if err != nil {
 			panic(err)
 		}
+		if interval := viper.GetDuration("keystone.revocation_poll_interval"); interval > 0 {
+			go d.pollRevocationEvents(interval)
+		}
+		if interval := viper.GetDuration("keystone.project_tree_refresh_interval"); interval > 0 {
+			go d.refreshProjectTrees(interval)
+		}
 	}
 }
 
@@ -123,13 +146,85 @@ func newKeystoneClient() (*gophercloud.ServiceClient, error) {
 	return client, nil
 }
 
+// requestContextTransport passes the request ID and the trace context on to Keystone
+type requestContextTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *requestContextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// do not modify the original request (see http.RoundTripper)
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	if requestID := util.RequestIDFromContext(t.ctx); requestID != "" {
+		r.Header.Set(util.RequestIDHeader, requestID)
+	}
+
+	span := tracing.StartClientSpan(t.ctx, r, "keystone "+r.URL.Path)
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		tracing.EndSpan(span, err)
+		return nil, err
+	}
+	tracing.EndHTTPSpan(span, resp.StatusCode)
+	return resp, nil
+}
+
+// withRequestContext returns a copy of the client that passes the request ID and trace context from ctx on to Keystone.
+func withRequestContext(ctx context.Context, client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	if client == nil {
+		return client
+	}
+
+	// the token of the shared provider changes on reauthentication, so it must only be accessed through its lock
+	shared := client.ProviderClient
+	provider := &gophercloud.ProviderClient{
+		IdentityBase:      shared.IdentityBase,
+		IdentityEndpoint:  shared.IdentityEndpoint,
+		EndpointLocator:   shared.EndpointLocator,
+		HTTPClient:        shared.HTTPClient,
+		UserAgent:         shared.UserAgent,
+		RetryBackoffFunc:  shared.RetryBackoffFunc,
+		MaxBackoffRetries: shared.MaxBackoffRetries,
+		RetryFunc:         shared.RetryFunc,
+	}
+	// requests are cancelled along with ctx
+	provider.Context = ctx
+	provider.UseTokenLock()
+	provider.SetToken(shared.Token())
+	transport := provider.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	provider.HTTPClient.Transport = &requestContextTransport{base: transport, ctx: ctx}
+	if shared.ReauthFunc != nil {
+		// reauthenticate the shared provider (only once for concurrent requests) and take over its new token
+		provider.ReauthFunc = func() error {
+			if err := shared.Reauthenticate(provider.Token()); err != nil {
+				return err
+			}
+			provider.SetToken(shared.Token())
+			return nil
+		}
+	}
+	sc := *client
+	sc.ProviderClient = provider
+	return &sc
+}
+
 type keystoneToken struct {
 	DomainScope  keystoneTokenThing         `json:"domain"`
 	ProjectScope keystoneTokenThingInDomain `json:"project"`
 	Roles        []keystoneTokenThing       `json:"roles"`
 	User         keystoneTokenThingInDomain `json:"user"`
 	Token        string
-	ExpiresAt    string `json:"expires_at"`
+	ExpiresAt    string   `json:"expires_at"`
+	IssuedAt     string   `json:"issued_at"`
+	AuditIDs     []string `json:"audit_ids"`
 }
 
 type keystoneTokenThing struct {
@@ -179,9 +274,9 @@ func (t *keystoneToken) ToContext() policy.Context {
 }
 
 type cacheEntry struct {
-	context     *policy.Context
-	endpointURL string
-	projectTree []string
+	// the authorization context is derived from the token, which is also used to match revocation events
+	Token       keystoneToken `json:"token"`
+	EndpointURL string        `json:"endpoint_url"`
 }
 
 // ServiceURL returns the service's global catalog entry
@@ -190,6 +285,17 @@ func (d *keystone) ServiceURL() string {
 	return d.serviceURL
 }
 
+// HealthCheck verifies that the identity service is reachable and the service user's token is still valid
+func (d *keystone) HealthCheck() error {
+	client, err := d.serviceKeystoneClient()
+	if err != nil {
+		return err
+	}
+
+	// validate the service token using itself
+	return tokens.Get(client, client.Token()).Err
+}
+
 // reauthServiceUser refreshes an expired keystone token
 func (d *keystone) reauthServiceUser() error {
 	d.serviceTokenMutex.Lock()
@@ -220,7 +326,7 @@ func (d *keystone) reauthServiceUser() error {
 
 	// store token so that it is considered for next authentication attempt
 	viper.Set("keystone.token", token.ID)
-	d.providerClient.TokenID = token.ID
+	d.providerClient.SetToken(token.ID)
 	d.providerClient.ReauthFunc = d.reauthServiceUser
 	d.providerClient.EndpointLocator = func(opts gophercloud.EndpointOpts) (string, error) {
 		return openstack.V3EndpointURL(catalog, opts)
@@ -317,7 +423,7 @@ func authOpts2StringKey(authOpts *tokens.AuthOptions) string {
 // Authenticate authenticates a non-service user using available authOptionsFromRequest (username+password or token)
 // It returns the authorization context
 func (d *keystone) Authenticate(authOpts *tokens.AuthOptions) (*policy.Context, string, AuthenticationError) {
-	return d.authenticate(authOpts, false)
+	return d.authenticate(context.Background(), authOpts, false)
 }
 
 // AuthenticateRequest attempts to Authenticate a user using the request header contents
@@ -335,7 +441,7 @@ func (d *keystone) AuthenticateRequest(r *http.Request, guessScope bool) (*polic
 	// if the request does not have a keystone token, then a new token has to be requested on behalf of the client
 	// this must not happen with the connection of the service otherwise wrong credentials will cause reauthentication
 	// of the service user
-	context, _, err := d.authenticate(authOpts, true)
+	context, _, err := d.authenticate(r.Context(), authOpts, true)
 	if err != nil {
 		return nil, err
 	}
@@ -410,7 +516,7 @@ func (d *keystone) authOptionsFromRequest(r *http.Request, guessScope bool) (*to
 		} else if len(scopeParts) >= 1 {
 			ba.Scope.ProjectID = scopeParts[0]
 		} else if guessScope {
-			if err := d.guessScope(&ba); err != nil {
+			if err := d.guessScope(r.Context(), &ba); err != nil {
 				return nil, err
 			}
 		}
@@ -440,39 +546,48 @@ func (d *keystone) authOptionsFromRequest(r *http.Request, guessScope bool) (*to
 	return &ba, nil
 }
 
-func (d *keystone) guessScope(ba *tokens.AuthOptions) AuthenticationError {
+func (d *keystone) guessScope(ctx context.Context, ba *tokens.AuthOptions) AuthenticationError {
 	// guess scope if it is missing
 	userID := ba.UserID
 	var err error
 	if userID == "" {
-		userID, err = d.UserID(ba.Username, ba.DomainName)
+		userID, err = d.UserID(ctx, ba.Username, ba.DomainName)
 		if err != nil {
 			return NewAuthenticationError(StatusWrongCredentials, err.Error())
 		}
 	}
-	projects, err := d.UserProjects(userID)
+	projects, err := d.UserProjects(ctx, userID)
 	if err != nil {
 		return NewAuthenticationError(StatusNotAvailable, err.Error())
 	} else if len(projects) == 0 {
 		return NewAuthenticationError(StatusNoPermission, "User %s (%s@%s) does not have monitoring authorization on any project in any domain (required roles: %s)", userID, ba.Username, ba.DomainName, viper.GetString("keystone.roles"))
 	}
 
-	// default to first project (note that redundant attributes are not copied here to aovid errors)
-	ba.Scope.ProjectID = projects[0].ProjectID
-	if ba.Scope.ProjectID == "" {
-		ba.Scope.DomainID = projects[0].DomainID
+	// default to first project and only fall back to a domain if there is none (note that redundant attributes are not
+	// copied here to aovid errors)
+	for _, scope := range projects {
+		if scope.ProjectID != "" {
+			ba.Scope.ProjectID = scope.ProjectID
+			return nil
+		}
 	}
+	ba.Scope.DomainID = projects[0].DomainID
 
 	return nil
 }
 
 // authenticate authenticates a user using available authOptionsFromRequest (username+password or token)
 // It returns the authorization context
-func (d *keystone) authenticate(authOpts *tokens.AuthOptions, asServiceUser bool) (*policy.Context, string, AuthenticationError) {
+func (d *keystone) authenticate(ctx context.Context, authOpts *tokens.AuthOptions, asServiceUser bool) (*policy.Context, string, AuthenticationError) {
 	// check cache briefly
-	if entry, found := d.tokenCache.Get(authOpts2StringKey(authOpts)); found {
-		util.LogDebug("Token cache hit for %s", authOpts.TokenID)
-		return entry.(*cacheEntry).context, entry.(*cacheEntry).endpointURL, nil
+	var entry cacheEntry
+	if d.getCached(d.tokenCache, authOpts2StringKey(authOpts), &entry) {
+		if !d.isRevoked(&entry.Token) {
+			util.LogDebug("Token cache hit for %s", authOpts.TokenID)
+			context := entry.Token.ToContext()
+			return &context, entry.EndpointURL, nil
+		}
+		d.tokenCache.Delete(authOpts2StringKey(authOpts))
 	}
 
 	//use a custom token struct instead of tokens.Token which is way incomplete
@@ -482,13 +597,13 @@ func (d *keystone) authenticate(authOpts *tokens.AuthOptions, asServiceUser bool
 	if authOpts.TokenID != "" && authOpts.Scope == emptyScope && asServiceUser {
 		util.LogDebug("verify token")
 		// get token from token-ID which is being verified on that occasion
-		if d.providerClient.TokenID == "" {
+		if d.providerClient.Token() == "" {
 			err := d.reauthServiceUser().(AuthenticationError)
 			if err != nil {
 				return nil, "", err
 			}
 		}
-		response := tokens.Get(d.providerClient, authOpts.TokenID)
+		response := tokens.Get(withRequestContext(ctx, d.providerClient), authOpts.TokenID)
 		if response.Err != nil {
 			//this includes 4xx responses, so after this point, we can be sure that the token is valid
 			return nil, "", NewAuthenticationError(StatusWrongCredentials, response.Err.Error())
@@ -508,7 +623,7 @@ func (d *keystone) authenticate(authOpts *tokens.AuthOptions, asServiceUser bool
 			return nil, "", NewAuthenticationError(StatusNotAvailable, err.Error())
 		}
 		// create new token from basic authentication credentials or token ID
-		response := tokens.Create(client, authOpts)
+		response := tokens.Create(withRequestContext(ctx, client), authOpts)
 		// ugly copy & paste because the base-type of CreateResult and GetResult is private
 		if response.Err != nil {
 			statusCode := StatusWrongCredentials
@@ -542,88 +657,107 @@ func (d *keystone) authenticate(authOpts *tokens.AuthOptions, asServiceUser bool
 	if err != nil {
 		return nil, "", NewAuthenticationError(StatusNotAvailable, err.Error())
 	}
-	// update the cache
-	ce := cacheEntry{
-		context:     &context,
-		endpointURL: endpointURL,
+	// update the cache, but never keep a token beyond its expiry
+	ttl := viper.GetDuration("keystone.token_cache_time")
+	if expiresAt, err := time.Parse(time.RFC3339Nano, tokenData.ExpiresAt); err == nil {
+		if remaining := time.Until(expiresAt); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl > 0 {
+		ce := cacheEntry{
+			Token:       tokenData,
+			EndpointURL: endpointURL,
+		}
+		d.setCached(d.tokenCache, authOpts2StringKey(authOpts), &ce, ttl, "user/"+tokenData.User.ID, "project/"+tokenData.ProjectScope.ID)
 	}
-	d.tokenCache.Set(authOpts2StringKey(authOpts), &ce, cache.DefaultExpiration)
 	return &context, endpointURL, nil
 }
 
-func (d *keystone) ChildProjects(projectID string) ([]string, error) {
-	if ce, ok := d.projectTreeCache.Get(projectID); ok {
-		return ce.([]string), nil
+func (d *keystone) ChildProjects(ctx context.Context, projectID string) ([]string, error) {
+	d.trackProjectTree(projectID)
+
+	var projectIDs []string
+	cached := d.getCached(d.projectTreeCache, projectID, &projectIDs)
+	tracing.SetCacheHit(ctx, cached)
+	if cached {
+		return projectIDs, nil
 	}
 
-	projects, err := d.fetchChildProjects(projectID)
+	projects, err := d.loadChildProjects(ctx, projectID)
 	if err != nil {
 		util.LogError("Unable to obtain project tree of project %s: %v", projectID, err)
 		return nil, err
 	}
-
-	d.projectTreeCache.Set(projectID, projects, cache.DefaultExpiration)
 	return projects, nil
 }
 
-func (d *keystone) fetchChildProjects(projectID string) ([]string, error) {
-	projectIDs := []string{}
-	enabledVal := true
-	err := projects.List(d.providerClient, projects.ListOpts{ParentID: projectID, Enabled: &enabledVal}).EachPage(func(page pagination.Page) (bool, error) {
-		slice, err := projects.ExtractProjects(page)
-		if err != nil {
-			return false, err
-		}
-		for _, p := range slice {
-			projectIDs = append(projectIDs, p.ID)
-			children, err := d.fetchChildProjects(p.ID)
-			if err != nil {
-				return false, err
-			}
-			projectIDs = append(projectIDs, children...)
-		}
-
-		return true, nil
-	})
-	if err != nil {
-		return nil, err
+func (d *keystone) UserProjects(ctx context.Context, userID string) ([]tokens.Scope, error) {
+	var scopes []tokens.Scope
+	if d.getCached(d.userProjectsCache, userID, &scopes) {
+		return scopes, nil
 	}
-	return projectIDs, nil
-}
 
-func (d *keystone) UserProjects(userID string) ([]tokens.Scope, error) {
-	if up, ok := d.userProjectsCache.Get(userID); ok {
-		return up.([]tokens.Scope), nil
-	}
-
-	up, err := d.fetchUserProjects(userID)
+	up, err := d.fetchUserProjects(withRequestContext(ctx, d.providerClient), userID)
 	if err != nil {
 		util.LogError("Unable to obtain monitoring project list of user %s: %v", userID, err)
 		return nil, err
 	}
 
 	// cache should be updated at this point
-	d.userProjectsCache.Set(userID, up, cache.DefaultExpiration)
+	d.setCached(d.userProjectsCache, userID, up, viper.GetDuration("keystone.token_cache_time"), "user/"+userID, "projects")
 	return up, nil
 }
 
-func (d *keystone) fetchUserProjects(userID string) ([]tokens.Scope, error) {
+// roleAssignment is a role assignment listed with include_names (roles.RoleAssignment lacks names and inheritance)
+type roleAssignment struct {
+	Role  keystoneTokenThing `json:"role"`
+	Scope struct {
+		Project     keystoneTokenThingInDomain `json:"project"`
+		Domain      keystoneTokenThing         `json:"domain"`
+		InheritedTo string                     `json:"OS-INHERIT:inherited_to"`
+	} `json:"scope"`
+}
+
+// effectiveRoleAssignmentsOpts lists the effective role assignments of a user, i.e. group memberships and
+// inherited roles are resolved by Keystone, including the names of projects and domains
+type effectiveRoleAssignmentsOpts struct {
+	userID string
+}
+
+func (opts effectiveRoleAssignmentsOpts) ToRolesListAssignmentsQuery() (string, error) {
+	q := url.Values{"user.id": {opts.userID}, "effective": {"true"}, "include_names": {"true"}}
+	return "?" + q.Encode(), nil
+}
+
+func (d *keystone) fetchUserProjects(client *gophercloud.ServiceClient, userID string) ([]tokens.Scope, error) {
 	scopes := []tokens.Scope{}
-	effectiveVal := true
-	err := roles.ListAssignments(d.providerClient, roles.ListAssignmentsOpts{UserID: userID, Effective: &effectiveVal}).EachPage(func(page pagination.Page) (bool, error) {
-		slice, err := roles.ExtractRoleAssignments(page)
-		if err != nil {
+	seen := map[tokens.Scope]bool{}
+	err := roles.ListAssignments(client, effectiveRoleAssignmentsOpts{userID: userID}).EachPage(func(page pagination.Page) (bool, error) {
+		var result struct {
+			RoleAssignments []roleAssignment `json:"role_assignments"`
+		}
+		if err := page.(roles.RoleAssignmentPage).ExtractInto(&result); err != nil {
 			return false, err
 		}
-		for _, ra := range slice {
-			if _, ok := d.monitoringRoles[ra.Role.ID]; ok && ra.Scope.Project.ID != "" {
-				project, err := projects.Get(d.providerClient, ra.Scope.Project.ID).Extract()
-				if err != nil {
-					return false, err
-				}
-				domainName := d.domainNames[project.DomainID]
-				scopes = append(scopes, tokens.Scope{ProjectID: ra.Scope.Project.ID, ProjectName: project.Name,
-					DomainID: project.DomainID, DomainName: domainName})
+		for _, ra := range result.RoleAssignments {
+			// inherited roles apply to the subprojects only, which are listed separately
+			if _, ok := d.monitoringRoles[ra.Role.ID]; !ok || ra.Scope.InheritedTo != "" {
+				continue
+			}
+			var scope tokens.Scope
+			if ra.Scope.Project.ID != "" {
+				scope = tokens.Scope{ProjectID: ra.Scope.Project.ID, ProjectName: ra.Scope.Project.Name,
+					DomainID: ra.Scope.Project.Domain.ID, DomainName: ra.Scope.Project.Domain.Name}
+			} else if ra.Scope.Domain.ID != "" {
+				scope = tokens.Scope{DomainID: ra.Scope.Domain.ID, DomainName: ra.Scope.Domain.Name}
+			} else {
+				continue
+			}
+			// the same scope is listed for every role and every group granting it
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
 			}
 		}
 		return true, nil
@@ -632,30 +766,106 @@ func (d *keystone) fetchUserProjects(userID string) ([]tokens.Scope, error) {
 		return nil, err
 	}
 
+	// older Keystone versions ignore include_names
+	missing := []string{}
+	for _, scope := range scopes {
+		if scope.ProjectID != "" && (scope.ProjectName == "" || scope.DomainID == "") {
+			missing = append(missing, scope.ProjectID)
+		}
+	}
+	infos, err := d.projectInfos(client, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i := range scopes {
+		if info, ok := infos[scopes[i].ProjectID]; ok {
+			scopes[i].ProjectName, scopes[i].DomainID = info.Name, info.DomainID
+		}
+		if scopes[i].DomainName == "" {
+			scopes[i].DomainName = d.domainNames[scopes[i].DomainID]
+		}
+	}
+
 	return scopes, nil
 }
 
-func (d *keystone) UserID(username, userDomain string) (string, error) {
+// projectInfo holds the project details needed to describe a scope
+type projectInfo struct {
+	Name     string `json:"name"`
+	DomainID string `json:"domain_id"`
+}
+
+// projectInfos looks up the details of the given projects, fetching those not cached in parallel
+func (d *keystone) projectInfos(client *gophercloud.ServiceClient, projectIDs []string) (map[string]projectInfo, error) {
+	result := map[string]projectInfo{}
+	missing := []string{}
+	for _, id := range projectIDs {
+		var info projectInfo
+		if d.getCached(d.projectCache, id, &info) {
+			result[id] = info
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	var (
+		mutex    sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	concurrency := viper.GetInt("keystone.project_tree_concurrency")
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	for _, id := range missing {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			project, err := projects.Get(client, id).Extract()
+			<-semaphore
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			info := projectInfo{Name: project.Name, DomainID: project.DomainID}
+			result[id] = info
+			d.setCached(d.projectCache, id, info, viper.GetDuration("keystone.token_cache_time"), "projects")
+		}(id)
+	}
+	wg.Wait()
+
+	return result, firstErr
+}
+
+func (d *keystone) UserID(ctx context.Context, username, userDomain string) (string, error) {
 	key := username + "@" + userDomain
-	if ce, ok := d.userIDCache.Get(key); ok {
-		return ce.(string), nil
+	var userID string
+	if d.getCached(d.userIDCache, key, &userID) {
+		return userID, nil
 	}
 
-	id, err := d.fetchUserID(username, userDomain)
+	id, err := d.fetchUserID(withRequestContext(ctx, d.providerClient), username, userDomain)
 	if err != nil {
 		return "", err
 	}
 
-	d.userIDCache.Set(key, id, cache.DefaultExpiration)
+	d.setCached(d.userIDCache, key, id, 0, "user/"+id)
 
 	return id, nil
 }
 
-func (d *keystone) fetchUserID(username string, userDomain string) (string, error) {
+func (d *keystone) fetchUserID(client *gophercloud.ServiceClient, username string, userDomain string) (string, error) {
 	userDomainID := d.domainIDs[userDomain]
 	userID := ""
 	enabled := true
-	err := users.List(d.providerClient, users.ListOpts{Name: username, DomainID: userDomainID, Enabled: &enabled}).EachPage(func(page pagination.Page) (bool, error) {
+	err := users.List(client, users.ListOpts{Name: username, DomainID: userDomainID, Enabled: &enabled}).EachPage(func(page pagination.Page) (bool, error) {
 		users, err := users.ExtractUsers(page)
 		if err != nil {
 			return false, err
@@ -1,12 +1,19 @@
 package keystone
 
 import (
+	"context"
+	"github.com/databus23/goslo.policy"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	"github.com/h2non/gock"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -27,6 +34,7 @@ func setupTest(t *testing.T) Driver {
 	viper.Set("keystone.project_domain_name", "Default")
 	viper.Set("keystone.policy_file", "../test/policy.json")
 	viper.Set("keystone.roles", "monitoring_admin,monitoring_viewer")
+	viper.Set("keystone.token_cache_time", "900s")
 
 	//create test driver with the domains and projects from start-data.sql
 	gock.New(baseURL).Post("/v3/auth/tokens").Reply(http.StatusCreated).File("fixtures/service_token_create.json").AddHeader("X-Subject-Token", serviceToken)
@@ -62,10 +70,12 @@ func TestChildProjects(t *testing.T) {
 
 	ks := setupTest(t)
 
+	// subtree_as_ids is not permitted --> walk the hierarchy
+	gock.New(baseURL).Get("/v3/projects/p00001").HeaderPresent("X-Auth-Token").Reply(http.StatusForbidden)
 	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/child_projects.json").AddHeader("Content-Type", "application/json")
 	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00002"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString("{ \"projects\": [] }").AddHeader("Content-Type", "application/json")
 
-	ids, err := ks.ChildProjects("p00001")
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
 
 	assert.Nil(t, err, "ChildProjects should not return error")
 	assert.EqualValues(t, []string{"p00002"}, ids)
@@ -73,6 +83,237 @@ func TestChildProjects(t *testing.T) {
 	assertDone(t)
 }
 
+func TestChildProjects_forbiddenSubtree(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// a forbidden subtree lookup of one project does not disable subtree lookups of the others
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusForbidden)
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{}, ids)
+
+	gock.New(baseURL).Get("/v3/projects/p00002").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00002", "subtree": {"p00003": null}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+	ids, err = ks.ChildProjects(context.Background(), "p00002")
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{"p00003"}, ids)
+
+	assertDone(t)
+}
+
+func TestChildProjects_unknownProject(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/projects/p00009").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusNotFound)
+	ids, err := ks.ChildProjects(context.Background(), "p00009")
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{}, ids)
+	assert.EqualValues(t, 0, ks.(*keystone).noSubtreeAsIDs, "subtree lookups should stay enabled")
+
+	assertDone(t)
+}
+
+func TestChildProjects_subtreeAsIDs(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00001", "subtree": {"p00003": null, "p00002": {"p00004": null}}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
+
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{"p00002", "p00004", "p00003"}, ids)
+
+	assertDone(t)
+}
+
+func TestChildProjects_subtreeAsIDsDisabled(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// disabled projects are skipped along with their subtree, like in the hierarchy walk
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00001", "domain_id": "d00001", "subtree": {"p00002": {"p00004": null}, "p00003": {"p00005": null}}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false", "domain_id": "d00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": [{"id": "p00003"}]}`).AddHeader("Content-Type", "application/json")
+
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
+
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{"p00002", "p00004"}, ids)
+
+	assertDone(t)
+}
+
+func TestChildProjects_walk(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+	viper.Set("keystone.project_tree_concurrency", 2)
+
+	// Keystone ignores subtree_as_ids
+	gock.New(baseURL).Get("/v3/projects/p00001").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/testproject.json").AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": [{"id": "p00002"}, {"id": "p00003"}, {"id": "p00004"}]}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00002"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": [{"id": "p00005"}]}`).AddHeader("Content-Type", "application/json")
+	for _, id := range []string{"p00003", "p00004", "p00005"} {
+		gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": id}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+	}
+
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
+
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{"p00002", "p00005", "p00003", "p00004"}, ids, "ChildProjects should list the projects depth-first")
+
+	assertDone(t)
+}
+
+func TestChildProjects_firstCallerCancelled(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).Delay(100*time.Millisecond).BodyString(`{"project": {"id": "p00001", "subtree": {"p00002": null}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := ks.ChildProjects(ctx, "p00001")
+		firstErr <- err
+	}()
+	for inProgress := false; !inProgress; {
+		time.Sleep(time.Millisecond)
+		ks.(*keystone).treeMutex.Lock()
+		_, inProgress = ks.(*keystone).treeFetches["p00001"]
+		ks.(*keystone).treeMutex.Unlock()
+	}
+
+	// the client that started the lookup disconnects, the other one still gets the tree
+	result := make(chan []string)
+	go func() {
+		ids, err := ks.ChildProjects(context.Background(), "p00001")
+		assert.Nil(t, err, "ChildProjects should not return error")
+		result <- ids
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-firstErr)
+	assert.EqualValues(t, []string{"p00002"}, <-result)
+
+	assertDone(t)
+}
+
+func TestChildProjects_disabledProjectsCached(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// the disabled projects are listed once for both trees of the domain
+	for i := 0; i < 2; i++ {
+		gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00001", "domain_id": "d00001", "subtree": {"p00002": null, "p00003": null}}}`).AddHeader("Content-Type", "application/json")
+		gock.New(baseURL).Get("/v3/projects/p00004").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00004", "domain_id": "d00001", "subtree": {"p00005": null}}}`).AddHeader("Content-Type", "application/json")
+		gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false", "domain_id": "d00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": [{"id": "p00003"}]}`).AddHeader("Content-Type", "application/json")
+
+		if i == 0 {
+			ids, err := ks.ChildProjects(context.Background(), "p00001")
+			assert.Nil(t, err, "ChildProjects should not return error")
+			assert.EqualValues(t, []string{"p00002"}, ids)
+			ids, err = ks.ChildProjects(context.Background(), "p00004")
+			assert.Nil(t, err, "ChildProjects should not return error")
+			assert.EqualValues(t, []string{"p00005"}, ids)
+		} else {
+			// ... and again when the trees are refreshed
+			ks.(*keystone).refreshPopularProjectTrees()
+		}
+		assertDone(t)
+	}
+}
+
+func TestRefreshPopularProjectTrees(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00001", "subtree": {"p00002": null}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+	_, err := ks.ChildProjects(context.Background(), "p00001")
+	assert.Nil(t, err, "ChildProjects should not return error")
+
+	// the tree is reloaded in the background once it has been invalidated
+	ks.FlushCache("", "p00002")
+	gock.New(baseURL).Get("/v3/projects/p00001").MatchParam("subtree_as_ids", "").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"project": {"id": "p00001", "subtree": {"p00003": null}}}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "false"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": []}`).AddHeader("Content-Type", "application/json")
+	ks.(*keystone).refreshPopularProjectTrees()
+
+	ids, err := ks.ChildProjects(context.Background(), "p00001")
+	assert.Nil(t, err, "ChildProjects should not return error")
+	assert.EqualValues(t, []string{"p00003"}, ids, "ChildProjects should return the refreshed tree")
+
+	assertDone(t)
+}
+
+func TestDomainProjects(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "is_domain": "false", "domain_id": "d00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"projects": [{"id": "p00001"}, {"id": "p00002"}]}`).AddHeader("Content-Type", "application/json")
+
+	ids, err := ks.DomainProjects(context.Background(), "d00001")
+	assert.Nil(t, err, "DomainProjects should not return error")
+	assert.EqualValues(t, []string{"p00001", "p00002"}, ids)
+	// cache hit
+	ids, err = ks.DomainProjects(context.Background(), "d00001")
+	assert.Nil(t, err, "DomainProjects should use the cache")
+	assert.EqualValues(t, []string{"p00001", "p00002"}, ids)
+
+	assertDone(t)
+}
+
+func TestUserProjects(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// names are included, so no projects need to be looked up
+	gock.New(baseURL).Get("/v3/role_assignments").MatchParams(map[string]string{"effective": "true", "include_names": "true", "user.id": "u00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/testuser_roles_names.json").AddHeader("Content-Type", "application/json")
+
+	scopes, err := ks.UserProjects(context.Background(), "u00001")
+
+	assert.Nil(t, err, "UserProjects should not return error")
+	assert.EqualValues(t, []tokens.Scope{
+		{ProjectID: "p00001", ProjectName: "testproject", DomainID: "d00001", DomainName: "testdomain"},
+		{DomainID: "d00001", DomainName: "testdomain"},
+		{ProjectID: "p00002", ProjectName: "Child", DomainID: "d00001", DomainName: "testdomain"},
+	}, scopes, "UserProjects should list each project and domain with a monitoring role once")
+
+	assertDone(t)
+}
+
+func TestUserProjects_withoutNames(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// Keystone ignores include_names, so the project details are looked up
+	gock.New(baseURL).Get("/v3/role_assignments").MatchParams(map[string]string{"effective": "true", "include_names": "true", "user.id": "u00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/testuser_roles.json").AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects/p00001").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/testproject.json").AddHeader("Content-Type", "application/json")
+
+	scopes, err := ks.UserProjects(context.Background(), "u00001")
+
+	assert.Nil(t, err, "UserProjects should not return error")
+	assert.EqualValues(t, []tokens.Scope{
+		{ProjectID: "p00001", ProjectName: "testproject", DomainID: "d00001", DomainName: "testdomain"},
+	}, scopes, "UserProjects should complete the scopes with the project details")
+
+	assertDone(t)
+}
+
 func TestAuthenticateRequest(t *testing.T) {
 	defer gock.Off()
 
@@ -142,3 +383,180 @@ func TestAuthenticateRequest_guessScope(t *testing.T) {
 
 	assertDone(t)
 }
+
+func TestGuessScope_preferProject(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// the domain role is listed before the project role
+	gock.New(baseURL).Get("/v3/role_assignments").MatchParams(map[string]string{"effective": "true", "user.id": "u00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"role_assignments": [
+		{"user": {"id": "u00001"}, "role": {"id": "r00001"}, "scope": {"domain": {"id": "d00001"}}},
+		{"user": {"id": "u00001"}, "role": {"id": "r00001"}, "scope": {"project": {"id": "p00001"}}}]}`).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects/p00001").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/testproject.json").AddHeader("Content-Type", "application/json")
+
+	ba := tokens.AuthOptions{UserID: "u00001"}
+	err := ks.(*keystone).guessScope(context.Background(), &ba)
+
+	assert.Nil(t, err, "guessScope should not fail")
+	assert.EqualValues(t, tokens.Scope{ProjectID: "p00001"}, ba.Scope, "guessScope should prefer the project over the domain")
+
+	assertDone(t)
+}
+
+func TestHealthCheck(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/auth/tokens").MatchHeader("X-Subject-Token", serviceToken).Reply(http.StatusOK).File("fixtures/service_token_create.json").AddHeader("X-Subject-Token", serviceToken).AddHeader("Content-Type", "application/json")
+
+	err := ks.HealthCheck()
+
+	assert.Nil(t, err, "HealthCheck should not fail when the service token is valid")
+
+	assertDone(t)
+}
+
+func TestWithRequestContext_reauth(t *testing.T) {
+	shared := &gophercloud.ProviderClient{}
+	shared.UseTokenLock()
+	shared.SetToken("old")
+	reauths := 0
+	shared.ReauthFunc = func() error {
+		reauths++
+		shared.SetToken("new")
+		return nil
+	}
+	client := &gophercloud.ServiceClient{ProviderClient: shared}
+
+	first := withRequestContext(context.Background(), client)
+	second := withRequestContext(context.Background(), client)
+	assert.Equal(t, "old", first.Token(), "copy should take over the token of the shared client")
+
+	assert.Nil(t, first.Reauthenticate("old"), "Reauthenticate should not fail")
+	assert.Equal(t, "new", first.Token(), "copy should take over the renewed token")
+	assert.Equal(t, "new", shared.Token(), "shared client should be reauthenticated")
+
+	// the second copy still holds the old token, but the shared client is already renewed
+	assert.Nil(t, second.Reauthenticate("old"), "Reauthenticate should not fail")
+	assert.Equal(t, "new", second.Token(), "copy should take over the renewed token")
+	assert.Equal(t, 1, reauths, "shared client should only be reauthenticated once")
+}
+
+// validUserToken returns the token validation fixture with an expiry date in the future
+func validUserToken(t *testing.T) string {
+	buf, err := ioutil.ReadFile("fixtures/user_token_validate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(string(buf), "2017-08-09T23:51:19.000000Z", time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano), 1)
+}
+
+func authenticateWithToken(ks Driver) (*policy.Context, AuthenticationError) {
+	req := httptest.NewRequest("GET", "http://maia/federate", nil)
+	req.Header.Set("X-Auth-Token", userToken)
+	return ks.AuthenticateRequest(req, false)
+}
+
+func TestAuthenticateRequest_expiredTokenNotCached(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	// the token of the fixture has expired long ago, so Keystone has to be asked every time
+	gock.New(baseURL).Get("/v3/auth/tokens").Times(2).Reply(http.StatusOK).File("fixtures/user_token_validate.json").AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+
+	for i := 0; i < 2; i++ {
+		_, err := authenticateWithToken(ks)
+		assert.Nil(t, err, "AuthenticateRequest should not fail")
+	}
+
+	assertDone(t)
+}
+
+func TestRevocationEvents(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusOK).BodyString(validUserToken(t)).AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+	var err error
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should not fail")
+	// cache hit
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should use the cached token")
+
+	// events of other users do not affect the token
+	gock.New(baseURL).Get("/v3/OS-REVOKE/events").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"events": [{"user_id": "u00002", "issued_before": "2099-01-01T00:00:00Z"}]}`).AddHeader("Content-Type", "application/json")
+	events, err := ks.(*keystone).fetchRevocationEvents(time.Now())
+	assert.Nil(t, err, "fetchRevocationEvents should not fail")
+	ks.(*keystone).recordRevocationEvents(events)
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "token of another user should still be cached")
+
+	gock.New(baseURL).Get("/v3/OS-REVOKE/events").HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString(`{"events": [{"audit_id": "xxxxxxxxxx", "issued_before": "2099-01-01T00:00:00Z"}]}`).AddHeader("Content-Type", "application/json")
+	events, err = ks.(*keystone).fetchRevocationEvents(time.Now())
+	assert.Nil(t, err, "fetchRevocationEvents should not fail")
+	ks.(*keystone).recordRevocationEvents(events)
+	// revoked token is validated again
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusNotFound)
+	_, err = authenticateWithToken(ks)
+	assert.NotNil(t, err, "revoked token should not be taken from the cache")
+
+	assertDone(t)
+}
+
+func TestFlushCache(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusOK).BodyString(validUserToken(t)).AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects/p00001").HeaderPresent("X-Auth-Token").Reply(http.StatusForbidden)
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/child_projects.json").AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00002"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString("{ \"projects\": [] }").AddHeader("Content-Type", "application/json")
+	var err error
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should not fail")
+	_, err = ks.ChildProjects(context.Background(), "p00001")
+	assert.Nil(t, err, "ChildProjects should not fail")
+
+	ks.FlushCache("", "p00002")
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "token scoped to another project should not be evicted")
+	// project tree containing the project is fetched again
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00001"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).File("fixtures/child_projects.json").AddHeader("Content-Type", "application/json")
+	gock.New(baseURL).Get("/v3/projects").MatchParams(map[string]string{"enabled": "true", "parent_id": "p00002"}).HeaderPresent("X-Auth-Token").Reply(http.StatusOK).BodyString("{ \"projects\": [] }").AddHeader("Content-Type", "application/json")
+	_, err = ks.ChildProjects(context.Background(), "p00001")
+	assert.Nil(t, err, "ChildProjects should not fail")
+
+	ks.FlushCache("u00001", "")
+	// token of the user is validated again
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusOK).BodyString(validUserToken(t)).AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should not fail")
+
+	assertDone(t)
+}
+
+func TestFlushCache_evictedGeneration(t *testing.T) {
+	defer gock.Off()
+
+	ks := setupTest(t)
+
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusOK).BodyString(validUserToken(t)).AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+	_, err := authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should not fail")
+
+	ks.FlushCache("u00001", "")
+	// the new generation of the user is evicted from the cache
+	ks.(*keystone).generationCache.Delete("user/u00001")
+	// token of the user is validated again, though no generation is known
+	gock.New(baseURL).Get("/v3/auth/tokens").Reply(http.StatusOK).BodyString(validUserToken(t)).AddHeader("X-Subject-Token", userToken).AddHeader("Content-Type", "application/json")
+	_, err = authenticateWithToken(ks)
+	assert.Nil(t, err, "AuthenticateRequest should not fail")
+
+	assertDone(t)
+}
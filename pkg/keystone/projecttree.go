@@ -0,0 +1,372 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keystone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/pagination"
+	"github.com/sapcc/maia/pkg/tracing"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// treeFetch is a project tree lookup in progress, shared by all requests waiting for it
+type treeFetch struct {
+	done     chan struct{}
+	projects []string
+	err      error
+}
+
+// trackProjectTree records that the tree of the project is in use, so that it is refreshed in the background
+func (d *keystone) trackProjectTree(projectID string) {
+	d.treeMutex.Lock()
+	defer d.treeMutex.Unlock()
+	d.treeUsage[projectID] = time.Now()
+}
+
+// loadChildProjects fetches the project tree and updates the cache. Concurrent lookups of the same tree are merged.
+// The lookup is not cancelled when the caller that started it gives up, since other callers may be waiting for it.
+func (d *keystone) loadChildProjects(ctx context.Context, projectID string) ([]string, error) {
+	d.treeMutex.Lock()
+	f, inProgress := d.treeFetches[projectID]
+	if !inProgress {
+		f = &treeFetch{done: make(chan struct{})}
+		d.treeFetches[projectID] = f
+		go d.fetchProjectTree(detachedContext{ctx}, projectID, f)
+	}
+	d.treeMutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.projects, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchProjectTree performs a shared project tree lookup and passes the result to everybody waiting for it
+func (d *keystone) fetchProjectTree(ctx context.Context, projectID string, f *treeFetch) {
+	if timeout := viper.GetDuration("keystone.project_tree_timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	f.projects, f.err = d.fetchChildProjects(withRequestContext(ctx, d.providerClient), projectID)
+	if f.err == nil {
+		// the tree also changes if some project within it is deleted, so depend on all projects
+		d.setCached(d.projectTreeCache, projectID, f.projects, viper.GetDuration("keystone.token_cache_time"), "projects")
+	}
+
+	d.treeMutex.Lock()
+	delete(d.treeFetches, projectID)
+	d.treeMutex.Unlock()
+	close(f.done)
+}
+
+// detachedContext passes on the values (request ID, trace) of a context, but neither its deadline nor its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// refreshProjectTrees periodically reloads the trees in use, so that requests do not have to wait for them
+func (d *keystone) refreshProjectTrees(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.refreshPopularProjectTrees()
+	}
+}
+
+// refreshPopularProjectTrees reloads all trees that have been requested within the token caching period
+func (d *keystone) refreshPopularProjectTrees() {
+	unused := time.Now().Add(-viper.GetDuration("keystone.token_cache_time"))
+	popular := []string{}
+	d.treeMutex.Lock()
+	for projectID, lastUsed := range d.treeUsage {
+		if lastUsed.Before(unused) {
+			delete(d.treeUsage, projectID)
+		} else {
+			popular = append(popular, projectID)
+		}
+	}
+	// the disabled projects are listed again (once per domain) for the new trees
+	for domainID := range d.disabledDomains {
+		d.projectTreeCache.Delete(disabledProjectsKey(domainID))
+	}
+	d.disabledDomains = map[string]bool{}
+	d.treeMutex.Unlock()
+
+	for _, projectID := range popular {
+		if _, err := d.loadChildProjects(context.Background(), projectID); err != nil {
+			util.LogWarning("Unable to refresh project tree of project %s: %v", projectID, err)
+		}
+	}
+}
+
+// fetchChildProjects obtains the IDs of all projects below the given one. It uses a single subtree_as_ids lookup
+// if Keystone permits it and walks the hierarchy level by level otherwise.
+func (d *keystone) fetchChildProjects(client *gophercloud.ServiceClient, projectID string) ([]string, error) {
+	if atomic.LoadInt32(&d.noSubtreeAsIDs) == 0 {
+		projectIDs, err := d.fetchSubtreeAsIDs(client, projectID)
+		switch err.(type) {
+		case nil:
+			return projectIDs, nil
+		case errSubtreeUnsupported:
+			util.LogInfo("Project subtree lookups are not available, walking the project hierarchy instead: %v", err)
+			atomic.StoreInt32(&d.noSubtreeAsIDs, 1)
+		case gophercloud.ErrDefault404:
+			// a project that does not exist (anymore) has no children
+			return []string{}, nil
+		case gophercloud.ErrDefault403:
+			// the policy may permit subtree lookups for some projects only, so just walk this one
+			util.LogDebug("Project subtree lookup of project %s is not permitted, walking the project hierarchy instead: %v", projectID, err)
+		default:
+			util.LogWarning("Project subtree lookup of project %s failed, walking the project hierarchy instead: %v", projectID, err)
+		}
+	}
+	return walkChildProjects(client, projectID, viper.GetInt("keystone.project_tree_concurrency"))
+}
+
+// errSubtreeUnsupported is returned if Keystone ignores the subtree_as_ids parameter
+type errSubtreeUnsupported struct{}
+
+func (errSubtreeUnsupported) Error() string {
+	return "no subtree in project details"
+}
+
+func (d *keystone) fetchSubtreeAsIDs(client *gophercloud.ServiceClient, projectID string) ([]string, error) {
+	var result struct {
+		Project map[string]json.RawMessage `json:"project"`
+	}
+	_, err := client.Get(client.ServiceURL("projects", projectID)+"?subtree_as_ids", &result, &gophercloud.RequestOpts{OkCodes: []int{200}})
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := result.Project["subtree"]
+	if !ok {
+		return nil, errSubtreeUnsupported{}
+	}
+
+	// the subtree is a nested map of project IDs (null for leaves)
+	var subtree map[string]interface{}
+	if err := json.Unmarshal(raw, &subtree); err != nil {
+		return nil, fmt.Errorf("malformed subtree of project %s: %s", projectID, err.Error())
+	}
+	// unlike the hierarchy walk, the subtree includes disabled projects: skip them together with their children
+	var domainID string
+	if raw, ok := result.Project["domain_id"]; ok {
+		if err := json.Unmarshal(raw, &domainID); err != nil {
+			return nil, fmt.Errorf("malformed domain of project %s: %s", projectID, err.Error())
+		}
+	}
+	disabled, err := d.disabledProjects(client, domainID)
+	if err != nil {
+		return nil, err
+	}
+	children := map[string][]string{}
+	var collect func(parentID string, tree map[string]interface{})
+	collect = func(parentID string, tree map[string]interface{}) {
+		for id, sub := range tree {
+			if disabled[id] {
+				continue
+			}
+			children[parentID] = append(children[parentID], id)
+			if m, ok := sub.(map[string]interface{}); ok {
+				collect(id, m)
+			}
+		}
+		sort.Strings(children[parentID])
+	}
+	collect(projectID, subtree)
+	return flattenProjectTree(children, projectID), nil
+}
+
+// walkChildProjects lists the children of every project in the tree, using up to concurrency requests in parallel
+func walkChildProjects(client *gophercloud.ServiceClient, projectID string, concurrency int) ([]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		mutex    sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	children := map[string][]string{}
+	semaphore := make(chan struct{}, concurrency)
+
+	var visit func(id string)
+	visit = func(id string) {
+		defer wg.Done()
+		semaphore <- struct{}{}
+		ids, err := listChildProjects(client, id)
+		<-semaphore
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if firstErr != nil {
+			return
+		}
+		children[id] = ids
+		for _, child := range ids {
+			wg.Add(1)
+			go visit(child)
+		}
+	}
+	wg.Add(1)
+	go visit(projectID)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return flattenProjectTree(children, projectID), nil
+}
+
+// DomainProjects returns the IDs of all projects in the domain
+func (d *keystone) DomainProjects(ctx context.Context, domainID string) ([]string, error) {
+	// project IDs and domain IDs are both UUIDs, so use a prefix to avoid clashes with project trees
+	key := "domain/" + domainID
+	var projectIDs []string
+	cached := d.getCached(d.projectTreeCache, key, &projectIDs)
+	tracing.SetCacheHit(ctx, cached)
+	if cached {
+		return projectIDs, nil
+	}
+
+	projectIDs, err := listDomainProjects(withRequestContext(ctx, d.providerClient), domainID)
+	if err != nil {
+		util.LogError("Unable to obtain projects of domain %s: %v", domainID, err)
+		return nil, err
+	}
+	d.setCached(d.projectTreeCache, key, projectIDs, viper.GetDuration("keystone.token_cache_time"), "projects")
+	return projectIDs, nil
+}
+
+// listDomainProjects lists the enabled projects of a domain on all levels of the hierarchy
+func listDomainProjects(client *gophercloud.ServiceClient, domainID string) ([]string, error) {
+	projectIDs := []string{}
+	enabledVal, isDomainVal := true, false
+	err := projects.List(client, projects.ListOpts{DomainID: domainID, Enabled: &enabledVal, IsDomain: &isDomainVal}).EachPage(func(page pagination.Page) (bool, error) {
+		slice, err := projects.ExtractProjects(page)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range slice {
+			projectIDs = append(projectIDs, p.ID)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return projectIDs, nil
+}
+
+// disabledProjects returns the IDs of the disabled projects of a domain. The list is cached until the project trees
+// are refreshed, so that it is shared by all trees of the domain.
+func (d *keystone) disabledProjects(client *gophercloud.ServiceClient, domainID string) (map[string]bool, error) {
+	var disabled map[string]bool
+	if d.getCached(d.projectTreeCache, disabledProjectsKey(domainID), &disabled) {
+		return disabled, nil
+	}
+
+	disabled, err := listDisabledProjects(client, domainID)
+	if err != nil {
+		return nil, err
+	}
+	d.setCached(d.projectTreeCache, disabledProjectsKey(domainID), disabled, viper.GetDuration("keystone.token_cache_time"), "projects")
+	d.treeMutex.Lock()
+	d.disabledDomains[domainID] = true
+	d.treeMutex.Unlock()
+	return disabled, nil
+}
+
+// disabledProjectsKey is the cache key of the disabled projects of a domain (prefixed like the domain projects)
+func disabledProjectsKey(domainID string) string {
+	return "disabled/" + domainID
+}
+
+// listDisabledProjects returns the IDs of the disabled projects of a domain (of all domains if domainID is empty)
+func listDisabledProjects(client *gophercloud.ServiceClient, domainID string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	enabledVal := false
+	err := projects.List(client, projects.ListOpts{DomainID: domainID, Enabled: &enabledVal}).EachPage(func(page pagination.Page) (bool, error) {
+		slice, err := projects.ExtractProjects(page)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range slice {
+			disabled[p.ID] = true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disabled, nil
+}
+
+// listChildProjects lists the enabled direct children of a project
+func listChildProjects(client *gophercloud.ServiceClient, projectID string) ([]string, error) {
+	projectIDs := []string{}
+	enabledVal := true
+	err := projects.List(client, projects.ListOpts{ParentID: projectID, Enabled: &enabledVal}).EachPage(func(page pagination.Page) (bool, error) {
+		slice, err := projects.ExtractProjects(page)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range slice {
+			projectIDs = append(projectIDs, p.ID)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return projectIDs, nil
+}
+
+// flattenProjectTree lists the projects below the given one in depth-first order
+func flattenProjectTree(children map[string][]string, projectID string) []string {
+	projectIDs := []string{}
+	for _, id := range children[projectID] {
+		projectIDs = append(projectIDs, id)
+		projectIDs = append(projectIDs, flattenProjectTree(children, id)...)
+	}
+	return projectIDs
+}
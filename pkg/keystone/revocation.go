@@ -0,0 +1,171 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keystone
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// revocationEvent is an entry of Keystone's list of revoked tokens (OS-REVOKE extension). Each attribute that is
+// set restricts the tokens affected by the event.
+type revocationEvent struct {
+	UserID       string `json:"user_id"`
+	ProjectID    string `json:"project_id"`
+	DomainID     string `json:"domain_id"`
+	RoleID       string `json:"role_id"`
+	TrustID      string `json:"trust_id"`
+	ConsumerID   string `json:"OS-OAUTH1:consumer_id"`
+	AuditID      string `json:"audit_id"`
+	AuditChainID string `json:"audit_chain_id"`
+	IssuedBefore string `json:"issued_before"`
+}
+
+// revokes checks whether the event applies to the token
+func (e *revocationEvent) revokes(t *keystoneToken) bool {
+	// Maia does not use trusts or OAuth
+	if e.TrustID != "" || e.ConsumerID != "" {
+		return false
+	}
+	if e.UserID != "" && e.UserID != t.User.ID {
+		return false
+	}
+	if e.ProjectID != "" && e.ProjectID != t.ProjectScope.ID {
+		return false
+	}
+	if e.DomainID != "" && e.DomainID != t.User.Domain.ID && e.DomainID != t.ProjectScope.Domain.ID && e.DomainID != t.DomainScope.ID {
+		return false
+	}
+	if e.RoleID != "" {
+		found := false
+		for _, role := range t.Roles {
+			found = found || role.ID == e.RoleID
+		}
+		if !found {
+			return false
+		}
+	}
+	// audit_ids contains the ID of the token and the ID of the token it has been derived from (if any)
+	if e.AuditID != "" && (len(t.AuditIDs) == 0 || e.AuditID != t.AuditIDs[0]) {
+		return false
+	}
+	if e.AuditChainID != "" && (len(t.AuditIDs) == 0 || e.AuditChainID != t.AuditIDs[len(t.AuditIDs)-1]) {
+		return false
+	}
+	if e.IssuedBefore != "" {
+		issuedBefore, err1 := time.Parse(time.RFC3339Nano, e.IssuedBefore)
+		issuedAt, err2 := time.Parse(time.RFC3339Nano, t.IssuedAt)
+		if err1 == nil && err2 == nil && issuedAt.After(issuedBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// recentRevocationEvent is a revocation event together with the time it has been received
+type recentRevocationEvent struct {
+	revocationEvent
+	received time.Time
+}
+
+// pollRevocationEvents periodically fetches the tokens revoked since the last poll. Since tokens may have been cached
+// by other replicas before this one has been started, the first poll covers the whole token caching period.
+func (d *keystone) pollRevocationEvents(interval time.Duration) {
+	since := time.Now().Add(-viper.GetDuration("keystone.token_cache_time"))
+	for {
+		now := time.Now()
+		// overlap the periods a bit to compensate for clock skew (recording an event twice does no harm)
+		events, err := d.fetchRevocationEvents(since.Add(-interval))
+		if err != nil {
+			util.LogWarning("Unable to obtain revoked tokens from Keystone: %v", err)
+		} else {
+			since = now
+			d.recordRevocationEvents(events)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (d *keystone) fetchRevocationEvents(since time.Time) ([]revocationEvent, error) {
+	client, err := d.serviceKeystoneClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Events []revocationEvent `json:"events"`
+	}
+	eventsURL := client.ServiceURL("OS-REVOKE", "events") + "?since=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+	_, err = client.Get(eventsURL, &result, &gophercloud.RequestOpts{OkCodes: []int{200}})
+	return result.Events, err
+}
+
+// recordRevocationEvents remembers the revocation events for as long as affected tokens might be cached. Shared caches
+// cannot be searched for affected tokens, so cached tokens are checked against these events when they are used.
+func (d *keystone) recordRevocationEvents(events []revocationEvent) {
+	now := time.Now()
+	expired := now.Add(-viper.GetDuration("keystone.token_cache_time"))
+
+	d.revocationMutex.Lock()
+	defer d.revocationMutex.Unlock()
+	recent := d.revocationEvents[:0]
+	for _, e := range d.revocationEvents {
+		if e.received.After(expired) {
+			recent = append(recent, e)
+		}
+	}
+	for _, e := range events {
+		recent = append(recent, recentRevocationEvent{revocationEvent: e, received: now})
+	}
+	d.revocationEvents = recent
+}
+
+// isRevoked checks whether the token is affected by one of the recorded revocation events
+func (d *keystone) isRevoked(t *keystoneToken) bool {
+	d.revocationMutex.RLock()
+	defer d.revocationMutex.RUnlock()
+	for i := range d.revocationEvents {
+		if d.revocationEvents[i].revokes(t) {
+			util.LogInfo("Ignoring revoked token of user %s in cache", t.User.ID)
+			return true
+		}
+	}
+	return false
+}
+
+// FlushCache removes everything cached about the given user and/or project
+func (d *keystone) FlushCache(userID, projectID string) {
+	if userID != "" {
+		// tokens, role assignments and name mappings of the user
+		d.invalidate("user/" + userID)
+		d.userProjectsCache.Delete(userID)
+	}
+
+	if projectID != "" {
+		// tokens scoped to the project
+		d.invalidate("project/" + projectID)
+		// the project might also be part of the tree of its parents or of the role assignments of arbitrary users
+		d.invalidate("projects")
+	}
+}
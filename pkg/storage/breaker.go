@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/maia/pkg/util"
+)
+
+// ErrCircuitOpen is returned without contacting the backend while the circuit breaker is open
+var ErrCircuitOpen = errors.New("Prometheus backend unavailable (circuit breaker open)")
+
+// states of the circuit breaker (values of the maia_backend_circuit_breaker_state metric)
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStateGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "maia_backend_circuit_breaker_state", Help: "State of the circuit breaker protecting the Prometheus backend (0 = closed, 1 = half-open, 2 = open)"})
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge)
+}
+
+// circuitBreaker stops sending requests to the backend after a number of consecutive failures. After the
+// cooldown period, a single probe request is let through: if it succeeds, the circuit is closed again.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// newCircuitBreaker creates a circuit breaker. A threshold of 0 disables it.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	breakerStateGauge.Set(breakerClosed)
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow checks whether a request may be sent to the backend
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		// only one probe at a time
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a request
+func (b *circuitBreaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			util.LogInfo("Prometheus backend available again: closing circuit breaker")
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		util.LogWarning("Prometheus backend failed %d times: opening circuit breaker for %s", b.failures, b.cooldown)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// abort releases the probe slot of a request that ended without telling anything about the backend (e.g. cancelled by the client)
+func (b *circuitBreaker) abort() {
+	b.mutex.Lock()
+	b.probing = false
+	b.mutex.Unlock()
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	breakerStateGauge.Set(float64(state))
+}
@@ -20,6 +20,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/prometheus/common/model"
@@ -33,6 +34,8 @@ const (
 	P8SProtoBuf string = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1"
 	// PlainText is used for readable federate output
 	PlainText = "text/plain; version=0.0.4"
+	// OpenMetrics is used for federate output in the OpenMetrics format (falls back to PlainText)
+	OpenMetrics = "application/openmetrics-text;version=1.0.0;q=0.9,text/plain;version=0.0.4;q=0.5"
 	// JSON is used to obtain output in JSON (--format json)
 	JSON = "application/json"
 )
@@ -81,6 +84,14 @@ type SeriesResponse struct {
 	Error     string           `json:"error,omitempty"`
 }
 
+// StatusResponse encapsulates a response to the /status/buildinfo and /status/flags APIs of Prometheus
+type StatusResponse struct {
+	Status    Status            `json:"status"`
+	Data      map[string]string `json:"data,omitempty"`
+	ErrorType ErrorType         `json:"errorType,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
 // LabelValuesResponse encapsulates a response to the /label/values API of Prometheus
 type LabelValuesResponse struct {
 	Status Status            `json:"status"`
@@ -95,13 +106,79 @@ type QueryResponse struct {
 	Error     string      `json:"error,omitempty"`
 }
 
+// ExemplarsResponse contains the response from a call to query_exemplars
+type ExemplarsResponse struct {
+	Status    Status            `json:"status"`
+	Data      []ExemplarsResult `json:"data"`
+	ErrorType ErrorType         `json:"errorType,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ExemplarsResult contains the exemplars of a single series
+type ExemplarsResult struct {
+	SeriesLabels model.LabelSet `json:"seriesLabels"`
+	Exemplars    []Exemplar     `json:"exemplars"`
+}
+
+// Exemplar is a sample with additional labels (usually a trace ID) referring to the event it was taken from
+type Exemplar struct {
+	Labels    model.LabelSet    `json:"labels"`
+	Value     model.SampleValue `json:"value"`
+	Timestamp model.Time        `json:"timestamp"`
+}
+
+// ExplainResponse contains the response from a call to the explain API of Maia, which describes how a query would be
+// processed without executing it
+type ExplainResponse struct {
+	Status Status      `json:"status"`
+	Data   ExplainData `json:"data"`
+}
+
+// ExplainData contains the original and the rewritten query, the scope of the request and hints about the cost of
+// the query
+type ExplainData struct {
+	Query          string       `json:"query"`
+	RewrittenQuery string       `json:"rewrittenQuery"`
+	Scope          ExplainScope `json:"scope"`
+	Findings       []string     `json:"findings"`
+}
+
+// ExplainScope describes the scope a query is restricted to
+type ExplainScope struct {
+	ProjectID     string              `json:"projectId,omitempty"`
+	DomainID      string              `json:"domainId,omitempty"`
+	ChildProjects []string            `json:"childProjects"`
+	Labels        map[string][]string `json:"labels"`
+	ShowAll       bool                `json:"showAll,omitempty"`
+}
+
+// CardinalityResponse contains the response from a call to the cardinality API of Maia
+type CardinalityResponse struct {
+	Status Status          `json:"status"`
+	Data   CardinalityData `json:"data"`
+}
+
+// CardinalityData lists the metric names with the most series and the labels with the most distinct values, highest
+// count first
+type CardinalityData struct {
+	TotalSeries                int                `json:"totalSeries"`
+	SeriesCountByMetricName    []CardinalityEntry `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName []CardinalityEntry `json:"labelValueCountByLabelName"`
+}
+
+// CardinalityEntry is a metric or label name together with its number of series resp. values
+type CardinalityEntry struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
 // QueryResult contains the actual result of a query or query_range call
 type QueryResult struct {
 	Type   model.ValueType `json:"resultType"`
 	Result interface{}     `json:"result"`
 
 	// The decoded value.
-	Value model.Value
+	Value model.Value `json:"-"`
 }
 
 // UnmarshalJSON contains a custom unmarshaller
@@ -116,12 +193,20 @@ func (qr *QueryResult) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	qr.Type = v.Type
 	switch v.Type {
 	case model.ValScalar:
 		var sv model.Scalar
 		err = json.Unmarshal(v.Result, &sv)
 		qr.Value = &sv
 
+	case model.ValString:
+		var str model.String
+		err = json.Unmarshal(v.Result, &str)
+		qr.Value = &str
+
+	// samples of native histograms are decoded into the Histogram field of the samples resp. the Histograms field of
+	// the series
 	case model.ValVector:
 		var vv model.Vector
 		err = json.Unmarshal(v.Result, &vv)
@@ -145,12 +230,24 @@ func (qr *QueryResult) UnmarshalJSON(b []byte) error {
 // we can avoid an entire in-memory unmarshal-marshal cycle.
 type Driver interface {
 	/********** requests to Prometheus **********/
-	Federate(selectors []string, acceptContentType string) (*http.Response, error)
-	Query(query, time, timeout string, acceptContentType string) (*http.Response, error)
-	QueryRange(query, start, end, step, timeout string, acceptContentType string) (*http.Response, error)
-	Series(match []string, start, end string, acceptContentType string) (*http.Response, error)
-	LabelValues(name string, acceptContentType string) (*http.Response, error)
+	// the context is used to pass request-scoped information (e.g. the request ID) on to the backend
+	Federate(ctx context.Context, selectors []string, acceptContentType string) (*http.Response, error)
+	Query(ctx context.Context, query, time, timeout string, acceptContentType string) (*http.Response, error)
+	QueryRange(ctx context.Context, query, start, end, step, timeout string, acceptContentType string) (*http.Response, error)
+	QueryExemplars(ctx context.Context, query, start, end string, acceptContentType string) (*http.Response, error)
+	Series(ctx context.Context, match []string, start, end string, acceptContentType string) (*http.Response, error)
+	LabelValues(ctx context.Context, name string, acceptContentType string) (*http.Response, error)
+	Status(ctx context.Context, kind string, acceptContentType string) (*http.Response, error)
 	DelegateRequest(request *http.Request) (*http.Response, error)
+	// HealthCheck verifies that the storage backend is reachable and able to answer queries
+	HealthCheck() error
+}
+
+// MaiaClient wraps the APIs that Maia offers in addition to the Prometheus API. Prometheus itself does not serve
+// them, so unlike Driver it is only used to talk to Maia.
+type MaiaClient interface {
+	Explain(ctx context.Context, query string, acceptContentType string) (*http.Response, error)
+	Cardinality(ctx context.Context, limit string, acceptContentType string) (*http.Response, error)
 }
 
 // NewPrometheusDriver is a factory method which chooses the right driver implementation based on configuration settings
@@ -0,0 +1,96 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+const histogramJSON = `{"count":"4","sum":"3.5","buckets":[[0,"0","1","3"],[0,"1","2","1"]]}`
+
+func decodeQueryResult(t *testing.T, data string) QueryResult {
+	var qr QueryResult
+	if err := json.Unmarshal([]byte(data), &qr); err != nil {
+		t.Fatal(err)
+	}
+	return qr
+}
+
+func TestQueryResult_vector(t *testing.T) {
+	qr := decodeQueryResult(t, `{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1499066783.997,"1"]}]}`)
+
+	vector, ok := qr.Value.(model.Vector)
+	if !ok || len(vector) != 1 {
+		t.Fatalf("unexpected value: %v", qr.Value)
+	}
+
+	// the result type has to survive re-encoding (e.g. after redacting labels)
+	qr.Result = qr.Value
+	data, err := json.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"resultType":"vector"`) {
+		t.Errorf("unexpected encoding: %s", data)
+	}
+}
+
+func TestQueryResult_string(t *testing.T) {
+	qr := decodeQueryResult(t, `{"resultType":"string","result":[1499066783.997,"hello"]}`)
+
+	if str, ok := qr.Value.(*model.String); !ok || str.Value != "hello" {
+		t.Errorf("unexpected value: %v", qr.Value)
+	}
+}
+
+func TestQueryResult_histogramVector(t *testing.T) {
+	qr := decodeQueryResult(t, `{"resultType":"vector","result":[{"metric":{"__name__":"request_duration_seconds"},"histogram":[1499066783.997,`+histogramJSON+`]}]}`)
+
+	vector, ok := qr.Value.(model.Vector)
+	if !ok || len(vector) != 1 || vector[0].Histogram == nil {
+		t.Fatalf("unexpected value: %v", qr.Value)
+	}
+	if h := vector[0].Histogram; h.Count != 4 || h.Sum != 3.5 || len(h.Buckets) != 2 {
+		t.Errorf("unexpected histogram: %v", h)
+	}
+}
+
+func TestQueryResult_histogramMatrix(t *testing.T) {
+	qr := decodeQueryResult(t, `{"resultType":"matrix","result":[{"metric":{"__name__":"request_duration_seconds"},"histograms":[[1499066783.997,`+histogramJSON+`],[1499066813.997,`+histogramJSON+`]]}]}`)
+
+	matrix, ok := qr.Value.(model.Matrix)
+	if !ok || len(matrix) != 1 || len(matrix[0].Histograms) != 2 {
+		t.Fatalf("unexpected value: %v", qr.Value)
+	}
+
+	// the result type has to survive re-encoding (e.g. after redacting labels)
+	qr.Result = qr.Value
+	data, err := json.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"resultType":"matrix"`) || !strings.Contains(string(data), `"histograms"`) {
+		t.Errorf("unexpected encoding: %s", data)
+	}
+}
@@ -0,0 +1,47 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"context"
+	"net/http"
+)
+
+// maiaClient sends requests to the Maia-specific APIs, using the same transport settings as the Prometheus driver
+type maiaClient struct {
+	*prometheusStorageClient
+}
+
+// NewMaiaClient creates a client for the APIs that only Maia offers
+func NewMaiaClient(maiaAPIURL string, customHeaders map[string]string) MaiaClient {
+	return &maiaClient{newPrometheusStorageClient(maiaAPIURL, customHeaders)}
+}
+
+func (c *maiaClient) Explain(ctx context.Context, query string, acceptContentType string) (*http.Response, error) {
+	maiaURL := c.buildURL("api/v1/explain", map[string]interface{}{"query": query})
+
+	return c.sendToPrometheus(ctx, "GET", maiaURL.String(), nil, map[string]string{"Accept": acceptContentType})
+}
+
+func (c *maiaClient) Cardinality(ctx context.Context, limit string, acceptContentType string) (*http.Response, error) {
+	maiaURL := c.buildURL("api/v1/cardinality", map[string]interface{}{"limit": limit})
+
+	return c.sendToPrometheus(ctx, "GET", maiaURL.String(), nil, map[string]string{"Accept": acceptContentType})
+}
@@ -20,24 +20,45 @@
 package storage
 
 import (
+	"context"
+	"net"
 	"net/http"
 
 	"net/url"
 
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/maia/pkg/tracing"
 	"github.com/sapcc/maia/pkg/util"
 	"github.com/spf13/viper"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
 )
 
 type prometheusStorageClient struct {
 	httpClient    *http.Client
 	url           *url.URL
 	customHeaders map[string]string
+	retries       int
+	retryBackoff  time.Duration
+	breaker       *circuitBreaker
+}
+
+var retriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "maia_backend_retries_count", Help: "Number of retried requests to the Prometheus backend"})
+
+func init() {
+	prometheus.MustRegister(retriesCounter)
 }
 
 // Prometheus creates a storage driver for Prometheus/Maia
 func Prometheus(prometheusAPIURL string, customHeaders map[string]string) Driver {
+	return newPrometheusStorageClient(prometheusAPIURL, customHeaders)
+}
+
+func newPrometheusStorageClient(prometheusAPIURL string, customHeaders map[string]string) *prometheusStorageClient {
 	parsedURL, err := url.Parse(prometheusAPIURL)
 	if err != nil {
 		panic(err)
@@ -51,55 +72,103 @@ func Prometheus(prometheusAPIURL string, customHeaders map[string]string) Driver
 }
 
 func (promCli *prometheusStorageClient) init() {
+	connectTimeout := viper.GetDuration("maia.prometheus_connect_timeout")
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: viper.GetDuration("maia.prometheus_response_timeout"),
+		MaxIdleConnsPerHost:   viper.GetInt("maia.prometheus_max_idle_conns"),
+		IdleConnTimeout:       90 * time.Second,
+	}
 	if viper.IsSet("maia.proxy") {
 		proxyURL, err := url.Parse(viper.GetString("maia.proxy"))
 		if err != nil {
 			panic(fmt.Errorf("Could not set proxy: %s .\n%s", proxyURL, err.Error()))
-		} else {
-			promCli.httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
-			return
 		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		panic(fmt.Errorf("Invalid TLS settings for Prometheus: %s", err.Error()))
 	}
-	promCli.httpClient = &http.Client{}
+	transport.TLSClientConfig = tlsConfig
+	roundTripper, err := newAuthTransport(transport)
+	if err != nil {
+		panic(fmt.Errorf("Invalid authentication settings for Prometheus: %s", err.Error()))
+	}
+	promCli.httpClient = &http.Client{Transport: roundTripper}
+
+	promCli.retries = viper.GetInt("maia.prometheus_retries")
+	promCli.retryBackoff = viper.GetDuration("maia.prometheus_retry_backoff")
+	promCli.breaker = newCircuitBreaker(viper.GetInt("maia.prometheus_breaker_threshold"), viper.GetDuration("maia.prometheus_breaker_cooldown"))
 }
 
-func (promCli *prometheusStorageClient) Query(query, time, timeout string, acceptContentType string) (*http.Response, error) {
+func (promCli *prometheusStorageClient) Query(ctx context.Context, query, time, timeout string, acceptContentType string) (*http.Response, error) {
 	promURL := promCli.buildURL("api/v1/query", map[string]interface{}{"query": query, "time": time, "timeout": timeout})
 
-	return promCli.sendToPrometheus("GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
 }
 
-func (promCli *prometheusStorageClient) QueryRange(query, start, end, step, timeout string, acceptContentType string) (*http.Response, error) {
+func (promCli *prometheusStorageClient) QueryRange(ctx context.Context, query, start, end, step, timeout string, acceptContentType string) (*http.Response, error) {
 	promURL := promCli.buildURL("api/v1/query_range", map[string]interface{}{"query": query, "start": start, "end": end,
 		"step": step, "timeout": timeout})
 
-	return promCli.sendToPrometheus("GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
 }
 
-func (promCli *prometheusStorageClient) Series(match []string, start, end string, acceptContentType string) (*http.Response, error) {
+func (promCli *prometheusStorageClient) QueryExemplars(ctx context.Context, query, start, end string, acceptContentType string) (*http.Response, error) {
+	promURL := promCli.buildURL("api/v1/query_exemplars", map[string]interface{}{"query": query, "start": start, "end": end})
+
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+}
+
+func (promCli *prometheusStorageClient) Series(ctx context.Context, match []string, start, end string, acceptContentType string) (*http.Response, error) {
 	promURL := promCli.buildURL("api/v1/series", map[string]interface{}{"match[]": match, "start": start, "end": end})
 
-	return promCli.sendToPrometheus("GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
 }
 
-func (promCli *prometheusStorageClient) LabelValues(name string, acceptContentType string) (*http.Response, error) {
+func (promCli *prometheusStorageClient) LabelValues(ctx context.Context, name string, acceptContentType string) (*http.Response, error) {
 	promURL := promCli.buildURL("api/v1/label/"+name+"/values", map[string]interface{}{})
 
-	res, err := promCli.sendToPrometheus("GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+	res, err := promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
 
 	return res, err
 }
 
-func (promCli *prometheusStorageClient) Federate(selectors []string, acceptContentType string) (*http.Response, error) {
+func (promCli *prometheusStorageClient) Status(ctx context.Context, kind string, acceptContentType string) (*http.Response, error) {
+	promURL := promCli.buildURL("api/v1/status/"+kind, map[string]interface{}{})
+
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+}
+
+func (promCli *prometheusStorageClient) Federate(ctx context.Context, selectors []string, acceptContentType string) (*http.Response, error) {
 	promURL := promCli.buildURL("federate", map[string]interface{}{"match[]": selectors})
 
-	return promCli.sendToPrometheus("GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
+	return promCli.sendToPrometheus(ctx, "GET", promURL.String(), nil, map[string]string{"Accept": acceptContentType})
 }
 
 func (promCli *prometheusStorageClient) DelegateRequest(request *http.Request) (*http.Response, error) {
 	promURL := promCli.mapURL(request.URL)
 
-	return promCli.sendToPrometheus(request.Method, promURL.String(), request.Body, map[string]string{"Accept": request.Header.Get("Accept")})
+	return promCli.sendToPrometheus(request.Context(), request.Method, promURL.String(), request.Body, map[string]string{"Accept": request.Header.Get("Accept")})
+}
+
+// HealthCheck performs a trivial query that does not touch any series
+func (promCli *prometheusStorageClient) HealthCheck() error {
+	promURL := promCli.buildURL("api/v1/query", map[string]interface{}{"query": "1"})
+
+	resp, err := promCli.sendToPrometheus(context.Background(), "GET", promURL.String(), nil, map[string]string{"Accept": JSON})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend responded with %s", resp.Status)
+	}
+	return nil
 }
 
 // buildURL is used to build the target URL of a Prometheus call
@@ -138,13 +207,68 @@ func (promCli *prometheusStorageClient) mapURL(maiaURL *url.URL) url.URL {
 	return promURL
 }
 
-// SendToPrometheus takes care of the request wrapping and delivery to Prometheus
-func (promCli *prometheusStorageClient) sendToPrometheus(method string, promURL string, body io.Reader, headers map[string]string) (*http.Response, error) {
+// SendToPrometheus takes care of the request wrapping and delivery to Prometheus. Idempotent requests are retried
+// on connection errors and 502/504 responses. While the circuit breaker is open, ErrCircuitOpen is returned immediately.
+func (promCli *prometheusStorageClient) sendToPrometheus(ctx context.Context, method string, promURL string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	if err := promCli.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	// only reads without request body can be repeated safely
+	retries := 0
+	if (method == http.MethodGet || method == http.MethodHead) && (body == nil || body == http.NoBody) {
+		retries = promCli.retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := promCli.send(ctx, method, promURL, body, headers)
+		if err == nil && !unreachable(resp.StatusCode) {
+			// Prometheus answered, even if it is an error like a query timeout (503) or an invalid query (422)
+			promCli.breaker.record(true)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// cancelled by the client: this does not tell anything about the backend
+			promCli.breaker.abort()
+			return resp, err
+		}
+		if attempt >= retries {
+			promCli.breaker.record(false)
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		backoff := promCli.backoff(attempt)
+		util.LogDebug("Retrying request to %s in %s", promURL, backoff)
+		retriesCounter.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			promCli.breaker.abort()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unreachable determines whether a status code has been set by a proxy because Prometheus could not be reached
+func unreachable(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusGatewayTimeout
+}
+
+// send performs a single attempt to deliver a request to Prometheus
+func (promCli *prometheusStorageClient) send(ctx context.Context, method string, promURL string, body io.Reader, headers map[string]string) (*http.Response, error) {
 	req, err := http.NewRequest(method, promURL, body)
 	if err != nil {
 		util.LogError("Could not create request.\n", err.Error())
 		return nil, err
 	}
+	req = req.WithContext(ctx)
+	if requestID := util.RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(util.RequestIDHeader, requestID)
+	}
 
 	for k, v := range promCli.customHeaders {
 		req.Header.Add(k, v)
@@ -155,10 +279,25 @@ func (promCli *prometheusStorageClient) sendToPrometheus(method string, promURL
 
 	util.LogDebug("Forwarding request to API: %s", promURL)
 
+	span := tracing.StartClientSpan(ctx, req, "prometheus "+req.URL.Path)
+	start := time.Now()
 	resp, err := promCli.httpClient.Do(req)
+	util.ObserveBackendDuration(ctx, time.Since(start))
 	if err != nil {
+		tracing.EndSpan(span, err)
 		util.LogError("Request failed.\n%s", err.Error())
 		return nil, err
 	}
+	tracing.EndHTTPSpan(span, resp.StatusCode)
 	return resp, nil
 }
+
+// backoff determines the delay before the next retry: exponential with jitter, so that retries of concurrent
+// requests do not hit the backend at the same time
+func (promCli *prometheusStorageClient) backoff(attempt int) time.Duration {
+	d := promCli.retryBackoff << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,276 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// backend is a Prometheus stand-in answering with the status codes in the given order (the last one is repeated)
+func backend(calls *int32, codes ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		if n > len(codes) {
+			n = len(codes)
+		}
+		w.WriteHeader(codes[n-1])
+		w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`))
+	}))
+}
+
+func setupClient(url string, retries, threshold int) *prometheusStorageClient {
+	viper.Set("maia.prometheus_retries", retries)
+	viper.Set("maia.prometheus_retry_backoff", "1ms")
+	viper.Set("maia.prometheus_breaker_threshold", threshold)
+	viper.Set("maia.prometheus_breaker_cooldown", "50ms")
+	return Prometheus(url, map[string]string{}).(*prometheusStorageClient)
+}
+
+func TestQuery_retry(t *testing.T) {
+	var calls int32
+	server := backend(&calls, http.StatusBadGateway, http.StatusGatewayTimeout, http.StatusOK)
+	defer server.Close()
+
+	promCli := setupClient(server.URL, 2, 5)
+	resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("expected success after 3 attempts, got %d after %d", resp.StatusCode, calls)
+	}
+}
+
+func TestQuery_retriesExhausted(t *testing.T) {
+	var calls int32
+	server := backend(&calls, http.StatusBadGateway)
+	defer server.Close()
+
+	promCli := setupClient(server.URL, 1, 5)
+	resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || calls != 2 {
+		t.Errorf("expected backend error to be returned after 2 attempts, got %d after %d", resp.StatusCode, calls)
+	}
+}
+
+func TestQuery_timeout(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`))
+	}))
+	defer server.Close()
+
+	promCli := setupClient(server.URL, 2, 1)
+	for i := 0; i < 2; i++ {
+		resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected the query timeout to be returned, got %d", resp.StatusCode)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected query timeouts not to be retried, got %d attempts for 2 queries", calls)
+	}
+	if promCli.breaker.state != breakerClosed {
+		t.Errorf("expected query timeouts not to open the circuit breaker")
+	}
+}
+
+func TestDelegateRequest_noRetry(t *testing.T) {
+	var calls int32
+	server := backend(&calls, http.StatusBadGateway, http.StatusOK)
+	defer server.Close()
+
+	promCli := setupClient(server.URL, 2, 5)
+	req := httptest.NewRequest("POST", "/api/v1/query", strings.NewReader("query=1"))
+	resp, err := promCli.DelegateRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls != 1 {
+		t.Errorf("expected requests with body not to be retried, got %d attempts", calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	server := backend(&calls, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK)
+	defer server.Close()
+
+	promCli := setupClient(server.URL, 0, 2)
+	for i := 0; i < 2; i++ {
+		resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if promCli.breaker.state != breakerOpen {
+		t.Fatalf("expected circuit breaker to open after 2 failures")
+	}
+
+	// fail fast
+	if _, err := promCli.Query(context.Background(), "1", "", "", JSON); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected backend not to be called while circuit is open, got %d calls", calls)
+	}
+
+	// probe after cooldown
+	time.Sleep(60 * time.Millisecond)
+	resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if promCli.breaker.state != breakerClosed {
+		t.Errorf("expected circuit breaker to close after successful probe")
+	}
+}
+
+// writeFile writes a (credentials) file and moves its modification time forward to mimic a rotation
+func writeFile(t *testing.T, path, content string, mtime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBearerToken_rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(dir, "token")
+	now := time.Now()
+	writeFile(t, tokenFile, "token1\n", now)
+	viper.Set("maia.prometheus_bearer_token_file", tokenFile)
+	defer viper.Set("maia.prometheus_bearer_token_file", "")
+	promCli := setupClient(server.URL, 0, 0)
+
+	for i, token := range []string{"token1", "token2"} {
+		if i > 0 {
+			writeFile(t, tokenFile, token+"\n", now.Add(time.Minute))
+		}
+		resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if authHeader != "Bearer "+token {
+			t.Errorf("expected bearer token %s, got header %q", token, authHeader)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	defer server.Close()
+
+	passwordFile := filepath.Join(dir, "password")
+	writeFile(t, passwordFile, "secret", time.Now())
+	viper.Set("maia.prometheus_username", "maia")
+	viper.Set("maia.prometheus_password_file", passwordFile)
+	defer viper.Set("maia.prometheus_username", "")
+	promCli := setupClient(server.URL, 0, 0)
+
+	resp, err := promCli.Query(context.Background(), "1", "", "", JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if username != "maia" || password != "secret" {
+		t.Errorf("expected basic auth maia:secret, got %s:%s", username, password)
+	}
+}
+
+func TestTLS_customCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// the test server's certificate is issued for example.com
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})), time.Now())
+	viper.Set("maia.prometheus_ca_file", caFile)
+	viper.Set("maia.prometheus_server_name", "example.com")
+	defer viper.Set("maia.prometheus_ca_file", "")
+	defer viper.Set("maia.prometheus_server_name", "")
+
+	resp, err := setupClient(server.URL, 0, 0).Query(context.Background(), "1", "", "", JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// without the CA, the server certificate cannot be verified
+	viper.Set("maia.prometheus_ca_file", "")
+	if _, err := setupClient(server.URL, 0, 0).Query(context.Background(), "1", "", "", JSON); err == nil {
+		t.Error("expected verification of the server certificate to fail")
+	}
+}
@@ -0,0 +1,189 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// watchedFile caches the content of a file and reloads it once it has been modified (e.g. rotated credentials)
+type watchedFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+func (f *watchedFile) read() ([]byte, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.content != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.content, nil
+	}
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.content, f.modTime, f.size = content, info.ModTime(), info.Size()
+	return content, nil
+}
+
+// readSecret reads a credential from a file (surrounding whitespace is ignored)
+func (f *watchedFile) readSecret() (string, error) {
+	content, err := f.read()
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %s", f.path, err.Error())
+	}
+	return string(bytes.TrimSpace(content)), nil
+}
+
+// newTLSConfig creates the TLS settings for the Prometheus backend (maia.prometheus_ca_file etc.). It returns nil
+// if nothing has been configured.
+func newTLSConfig() (*tls.Config, error) {
+	caFile := viper.GetString("maia.prometheus_ca_file")
+	certFile := viper.GetString("maia.prometheus_cert_file")
+	keyFile := viper.GetString("maia.prometheus_key_file")
+	serverName := viper.GetString("maia.prometheus_server_name")
+	insecure := viper.GetBool("maia.prometheus_insecure_skip_verify")
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %s", err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client certificate requires both maia.prometheus_cert_file and maia.prometheus_key_file")
+		}
+		cert, key := &watchedFile{path: certFile}, &watchedFile{path: keyFile}
+		// load the certificate for every handshake, so that it can be renewed without a restart
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certPEM, err := cert.read()
+			if err != nil {
+				return nil, err
+			}
+			keyPEM, err := key.read()
+			if err != nil {
+				return nil, err
+			}
+			c, err := tls.X509KeyPair(certPEM, keyPEM)
+			return &c, err
+		}
+		if _, err := config.GetClientCertificate(nil); err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %s", err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+// authTransport adds the credentials for the Prometheus backend to every request
+type authTransport struct {
+	base     http.RoundTripper
+	token    *watchedFile
+	username string
+	password *watchedFile
+}
+
+// newAuthTransport wraps the transport with backend authentication (bearer token or basic auth) if configured
+func newAuthTransport(base http.RoundTripper) (http.RoundTripper, error) {
+	tokenFile := viper.GetString("maia.prometheus_bearer_token_file")
+	username := viper.GetString("maia.prometheus_username")
+	if tokenFile == "" && username == "" {
+		return base, nil
+	}
+	if tokenFile != "" && username != "" {
+		return nil, fmt.Errorf("maia.prometheus_bearer_token_file and maia.prometheus_username are mutually exclusive")
+	}
+
+	t := &authTransport{base: base, username: username}
+	if tokenFile != "" {
+		t.token = &watchedFile{path: tokenFile}
+		if _, err := t.token.readSecret(); err != nil {
+			return nil, err
+		}
+	} else {
+		t.password = &watchedFile{path: viper.GetString("maia.prometheus_password_file")}
+		if _, err := t.password.readSecret(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// do not modify the original request (see http.RoundTripper)
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	if t.token != nil {
+		token, err := t.token.readSecret()
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		password, err := t.password.readSecret()
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		r.SetBasicAuth(t.username, password)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// closeBody closes the request body as required from a RoundTripper even in case of errors
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
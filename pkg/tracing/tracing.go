@@ -0,0 +1,117 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sapcc/maia/pkg/util"
+	"github.com/sapcc/maia/pkg/version"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/sapcc/maia"
+
+// Init sets up the W3C trace context propagation and, if an OTLP endpoint is configured (tracing.otlp_endpoint),
+// the export of spans. The returned function flushes pending spans and must be called on shutdown.
+func Init() (func(context.Context) error, error) {
+	// propagate trace context even if Maia itself does not export spans
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	endpoint := viper.GetString("tracing.otlp_endpoint")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if viper.GetBool("tracing.insecure") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing.sample_ratio")))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "maia"),
+			attribute.String("service.version", version.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	util.LogInfo("Exporting traces to %s", endpoint)
+
+	return provider.Shutdown, nil
+}
+
+// StartSpan creates a new span as child of the span in the context (if any)
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServerSpan continues the trace of an incoming request (if any) with a server span
+func StartServerSpan(req *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("http.target", req.URL.Path)))
+}
+
+// StartClientSpan creates a span for an outgoing HTTP request as child of the span in ctx and injects the trace
+// context into the request header
+func StartClientSpan(ctx context.Context, req *http.Request, name string) trace.Span {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("http.url", req.URL.Redacted())))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return span
+}
+
+// SetCacheHit records on the span in ctx (if any) whether the result was served from a cache
+func SetCacheHit(ctx context.Context, hit bool) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("maia.cache_hit", hit))
+}
+
+// EndSpan records the outcome of an operation and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EndHTTPSpan records the HTTP status code and ends the span. Server errors mark the span as failed.
+func EndHTTPSpan(span trace.Span, statusCode int) {
+	span.SetAttributes(attribute.Int("http.status_code", statusCode))
+	if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
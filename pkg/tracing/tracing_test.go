@@ -0,0 +1,140 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tracing
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// collector is a stand-in for an OpenTelemetry collector receiving OTLP/HTTP
+type collector struct {
+	server   *httptest.Server
+	requests chan *http.Request
+}
+
+func newCollector() *collector {
+	c := &collector{requests: make(chan *http.Request, 10)}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		c.requests <- r
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	return c
+}
+
+func TestInit(t *testing.T) {
+	c := newCollector()
+	defer c.server.Close()
+
+	viper.Set("tracing.otlp_endpoint", strings.TrimPrefix(c.server.URL, "http://"))
+	viper.Set("tracing.insecure", true)
+	viper.Set("tracing.sample_ratio", 1.0)
+	defer viper.Set("tracing.otlp_endpoint", "")
+
+	shutdown, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := StartSpan(context.Background(), "test")
+	req, _ := http.NewRequest("GET", "http://prometheus:9090/api/v1/query?query=up", nil)
+	clientSpan := StartClientSpan(ctx, req, "prometheus /api/v1/query")
+	EndHTTPSpan(clientSpan, http.StatusOK)
+	EndSpan(span, nil)
+
+	// W3C trace context: version-traceid-spanid-flags
+	expected := "00-" + span.SpanContext().TraceID().String() + "-" + clientSpan.SpanContext().SpanID().String() + "-01"
+	if tp := req.Header.Get("traceparent"); tp != expected {
+		t.Errorf("expected traceparent header %s, got %s", expected, tp)
+	}
+
+	// shutdown flushes the pending spans
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-c.requests:
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export request %s %s", r.Method, r.URL.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans exported to the collector")
+	}
+}
+
+func TestInit_disabled(t *testing.T) {
+	shutdown, err := Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	// without exporter, the trace of the caller is continued
+	req := httptest.NewRequest("GET", "/api/v1/query", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := StartServerSpan(req, "GET /api/v1/query")
+	defer span.End()
+
+	out, _ := http.NewRequest("GET", "http://prometheus:9090/api/v1/query", nil)
+	StartClientSpan(ctx, out, "prometheus /api/v1/query").End()
+	if tp := out.Header.Get("traceparent"); !strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Errorf("expected trace 4bf92f3577b34da6a3ce929d0e0e4736 to be continued, got %s", tp)
+	}
+}
+
+func TestSetCacheHit(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	ctx, span := StartSpan(context.Background(), "keystone.child_projects")
+	SetCacheHit(ctx, true)
+	EndSpan(span, nil)
+
+	// without span in the context this is a no-op
+	SetCacheHit(context.Background(), false)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	expected := attribute.Bool("maia.cache_hit", true)
+	for _, a := range spans[0].Attributes() {
+		if a == expected {
+			return
+		}
+	}
+	t.Errorf("expected attribute %v, got %v", expected, spans[0].Attributes())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/prometheus/common/model"
 	"github.com/sapcc/maia/pkg/keystone"
+	"github.com/sapcc/maia/pkg/version"
 	html_template "html/template"
 	"io"
 	"net/http"
@@ -24,7 +25,7 @@ func ExecuteTemplate(w http.ResponseWriter, req *http.Request, name string, keys
 			return time.Since(t) / time.Millisecond * time.Millisecond
 		},
 		"pathPrefix":   func() string { return "" },
-		"buildVersion": func() string { return "0.1" },
+		"buildVersion": func() string { return version.Version },
 		"stripLabels": func(lset model.LabelSet, labels ...model.LabelName) model.LabelSet {
 			for _, ln := range labels {
 				delete(lset, ln)
@@ -46,7 +47,7 @@ func ExecuteTemplate(w http.ResponseWriter, req *http.Request, name string, keys
 		//	return []string{}
 		//},
 		"childProjects": func() []string {
-			children, err := keystone.ChildProjects(req.Header.Get("X-Project-Id"))
+			children, err := keystone.ChildProjects(req.Context(), req.Header.Get("X-Project-Id"))
 			if err != nil {
 				return []string{}
 			}
@@ -55,10 +56,13 @@ func ExecuteTemplate(w http.ResponseWriter, req *http.Request, name string, keys
 		// return list of user's projects with monitoring role: name --> id
 		"userProjects": func() map[string]string {
 			result := map[string]string{}
-			projects, err := keystone.UserProjects(req.Header.Get("X-User-Id"))
+			projects, err := keystone.UserProjects(req.Context(), req.Header.Get("X-User-Id"))
 			if err == nil {
 				for _, p := range projects {
-					result[p.ProjectName] = p.ProjectID
+					// domain-level assignments do not correspond to a project
+					if p.ProjectID != "" {
+						result[p.ProjectName] = p.ProjectID
+					}
 				}
 			}
 			return result
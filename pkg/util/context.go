@@ -0,0 +1,94 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is the HTTP header used to pass request IDs from clients to Maia and from Maia to its backends
+const RequestIDHeader = "X-Request-Id"
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	backendTimerKey
+)
+
+// WithRequestID returns a copy of the context carrying the given request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID stored in the context (or empty string)
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// NewRequestID generates a random request ID
+func NewRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// BackendTimer accumulates the time spent waiting for backend responses while serving a request
+type BackendTimer struct {
+	mutex   sync.Mutex
+	elapsed time.Duration
+}
+
+// Elapsed returns the accumulated backend time
+func (t *BackendTimer) Elapsed() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.elapsed
+}
+
+// WithBackendTimer returns a copy of the context carrying a new backend timer
+func WithBackendTimer(ctx context.Context) (context.Context, *BackendTimer) {
+	timer := &BackendTimer{}
+	return context.WithValue(ctx, backendTimerKey, timer), timer
+}
+
+// ObserveBackendDuration adds the duration of a backend call to the timer in the context (if any)
+func ObserveBackendDuration(ctx context.Context, d time.Duration) {
+	if ctx == nil {
+		return
+	}
+	if timer, ok := ctx.Value(backendTimerKey).(*BackendTimer); ok {
+		timer.mutex.Lock()
+		timer.elapsed += d
+		timer.mutex.Unlock()
+	}
+}
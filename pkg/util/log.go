@@ -20,45 +20,105 @@
 package util
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 var isDebug = os.Getenv("MAIA_DEBUG") == "1"
+var isJSON = strings.EqualFold(os.Getenv("MAIA_LOG_FORMAT"), "json")
+var jsonLogger = log.New(os.Stderr, "", 0)
+
+//Fields contains additional attributes of a log record.
+type Fields map[string]interface{}
+
+//SetLogFormat selects the log format: "text" (default) or "json" for structured log records.
+func SetLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		isJSON = false
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("unsupported log format: %s", format)
+	}
+	return nil
+}
 
 //LogFatal logs a fatal error and terminates the program.
 func LogFatal(msg string, args ...interface{}) {
-	doLog("FATAL: "+msg, args)
+	doLog("FATAL", msg, args, nil)
 }
 
 //LogError logs a non-fatal error.
 func LogError(msg string, args ...interface{}) {
-	doLog("ERROR: "+msg, args)
+	doLog("ERROR", msg, args, nil)
 }
 
 //LogWarning logs a warning of a potential error.
 func LogWarning(msg string, args ...interface{}) {
-	doLog("WARNING: "+msg, args)
+	doLog("WARNING", msg, args, nil)
 }
 
 //LogInfo logs an informational message.
 func LogInfo(msg string, args ...interface{}) {
-	doLog("INFO: "+msg, args)
+	doLog("INFO", msg, args, nil)
+}
+
+//LogInfoWithFields logs an informational message with additional attributes.
+func LogInfoWithFields(fields Fields, msg string, args ...interface{}) {
+	doLog("INFO", msg, args, fields)
 }
 
 //LogDebug logs a debug message if debug logging is enabled.
 func LogDebug(msg string, args ...interface{}) {
 	if isDebug {
-		doLog("DEBUG: "+msg, args)
+		doLog("DEBUG", msg, args, nil)
 	}
 }
 
-func doLog(msg string, args []interface{}) {
+//LogDebugWithFields logs a debug message with additional attributes if debug logging is enabled.
+func LogDebugWithFields(fields Fields, msg string, args ...interface{}) {
+	if isDebug {
+		doLog("DEBUG", msg, args, fields)
+	}
+}
+
+func doLog(level string, msg string, args []interface{}, fields Fields) {
 	msg = strings.TrimPrefix(msg, "\n")
 	if len(args) > 0 {
-		log.Printf(msg+"\n", args...)
-	} else {
-		log.Println(msg)
+		msg = fmt.Sprintf(msg, args...)
+	}
+
+	if isJSON {
+		record := map[string]interface{}{}
+		for k, v := range fields {
+			record[k] = v
+		}
+		record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		record["level"] = strings.ToLower(level)
+		record["msg"] = msg
+		buf, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("ERROR: cannot marshal log record: %s\n", err.Error())
+			return
+		}
+		jsonLogger.Println(string(buf))
+		return
+	}
+
+	// text format: append fields as sorted key=value pairs
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, fields[k])
 	}
+	log.Println(level + ": " + msg)
 }
@@ -0,0 +1,80 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// ranges longer than this read a lot of samples per series
+	maxCheapRange = 24 * time.Hour
+	// subqueries with more steps than this evaluate their inner expression very often
+	maxCheapSubquerySteps = 1000
+)
+
+// AnalyzeExpressionCost looks for patterns in a PromQL expression which typically make it expensive to evaluate. It
+// returns a human-readable finding for each of them. The expression is not evaluated, so this is just a hint for the
+// user.
+func AnalyzeExpressionCost(expression string) ([]string, error) {
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := []string{}
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if !selectsMetricName(n.LabelMatchers) {
+				findings = append(findings, fmt.Sprintf("%s does not select a single metric name and may match a large number of series", n.String()))
+			}
+		case *parser.MatrixSelector:
+			if n.Range > maxCheapRange {
+				findings = append(findings, fmt.Sprintf("%s reads %s of samples per series, consider a shorter range or a recording rule", n.String(), model.Duration(n.Range)))
+			}
+		case *parser.SubqueryExpr:
+			if n.Range > maxCheapRange {
+				findings = append(findings, fmt.Sprintf("subquery %s covers %s, consider a shorter range or a recording rule", n.String(), model.Duration(n.Range)))
+			}
+			if n.Step > 0 && int64(n.Range/n.Step) > maxCheapSubquerySteps {
+				findings = append(findings, fmt.Sprintf("subquery %s evaluates its inner expression %d times, consider a larger step", n.String(), n.Range/n.Step))
+			}
+		}
+		return nil
+	})
+
+	return findings, nil
+}
+
+// selectsMetricName checks whether the matchers select exactly one metric name
+func selectsMetricName(matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeExpressionCost(t *testing.T) {
+	cases := []struct {
+		query    string
+		findings []string
+	}{
+		{"sum by (code) (rate(http_requests_total{job=\"api\"}[5m]))", nil},
+		{"{job=\"api\"}", []string{"{job=\"api\"} does not select a single metric name"}},
+		{"{__name__=~\"openstack_.*\"}", []string{"does not select a single metric name"}},
+		{"rate(http_requests_total[7d])", []string{"reads 1w of samples per series"}},
+		{"max_over_time(rate(http_requests_total[5m])[30d:1m])", []string{"covers 30d", "evaluates its inner expression 43200 times"}},
+	}
+	for _, c := range cases {
+		findings, err := AnalyzeExpressionCost(c.query)
+		if err != nil {
+			t.Errorf("%s: %s", c.query, err)
+			continue
+		}
+		if len(findings) != len(c.findings) {
+			t.Errorf("%s: expected %d findings, got %v", c.query, len(c.findings), findings)
+			continue
+		}
+		for i, expected := range c.findings {
+			if !strings.Contains(findings[i], expected) {
+				t.Errorf("%s: unexpected finding %q; should contain %q", c.query, findings[i], expected)
+			}
+		}
+	}
+}
+
+func TestAnalyzeExpressionCost_syntaxError(t *testing.T) {
+	if _, err := AnalyzeExpressionCost("sum("); err == nil {
+		t.Error("syntax error has not been reported")
+	}
+}
@@ -1,72 +1,577 @@
 package util
 
 import (
-	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/promql"
-	"github.com/prometheus/prometheus/storage/metric"
+	"fmt"
 	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 // AddLabelConstraintToExpression enhances a PromQL expression to limit it to series matching a certain label
 func AddLabelConstraintToExpression(expression string, key string, values []string) (string, error) {
-	exprNode, err := promql.ParseExpr(expression)
+	exprNode, err := parser.ParseExpr(expression)
 	if err != nil {
 		return "", err
 	}
-	matcher, err := makeLabelMatcher(key, values)
+	c, err := newConstraint(LabelConstraint{Key: key, Values: values})
 	if err != nil {
 		return "", err
 	}
 
-	// since to structure of the expression is not modified we can use a visitor, avoiding our own traversal code
-	promql.Walk(labelInjector{matcher: matcher}, exprNode)
+	// since to structure of the expression is not modified we can use a visitor, avoiding our own traversal code.
+	// Range vectors and subqueries are reached as well, since they wrap vector selectors and expressions respectively.
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		if err != nil {
+			return err
+		}
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			n.LabelMatchers, err = c.restrict(n.LabelMatchers)
+		default:
+			err = checkScopeLabelsKept(node, []constraint{c})
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
 
 	return exprNode.String(), nil
 }
 
 // AddLabelConstraintToSelector enhances a PromQL selector with an additional label selector
 func AddLabelConstraintToSelector(metricSelector string, key string, values []string) (string, error) {
-	matcher, err := makeLabelMatcher(key, values)
+	c, err := newConstraint(LabelConstraint{Key: key, Values: values})
 	if err != nil {
 		return "", err
 	}
 
-	var labelMatchers metric.LabelMatchers
+	var labelMatchers []*labels.Matcher
 	if metricSelector != "{}" {
-		labelMatchers, err = promql.ParseMetricSelector(metricSelector)
-	} else {
-		labelMatchers = make(metric.LabelMatchers, 0)
+		labelMatchers, err = parser.ParseMetricSelector(metricSelector)
 	}
 	if err != nil {
 		return "", err
 	}
-	return "{" + metric.LabelMatchers(append(labelMatchers, matcher)).String() + "}", nil
+	if labelMatchers, err = c.restrict(labelMatchers); err != nil {
+		return "", err
+	}
+	return "{" + matchersString(labelMatchers) + "}", nil
+}
+
+// LabelConstraint restricts series to those where the label has one of the values
+type LabelConstraint struct {
+	Key    string
+	Values []string
+}
+
+// ScopeViolationError is returned if a query or selector can only produce series outside of the label constraints,
+// or if it would overwrite the constrained labels
+type ScopeViolationError struct {
+	Reason string
+}
+
+func (e ScopeViolationError) Error() string {
+	return e.Reason
+}
+
+// constraint is a LabelConstraint together with the matcher enforcing it
+type constraint struct {
+	LabelConstraint
+	matcher *labels.Matcher
+}
+
+func newConstraint(lc LabelConstraint) (constraint, error) {
+	matcher, err := makeLabelMatcher(lc.Key, lc.Values)
+	return constraint{LabelConstraint: lc, matcher: matcher}, err
+}
+
+// restrict validates the matchers of a selector on the constrained label and appends the matcher of the constraint.
+// Matchers holding for all values of the constraint are redundant and therefore removed. If the matchers rule out
+// all values, the selector contradicts the constraint and a ScopeViolationError is returned.
+func (c constraint) restrict(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	result := make([]*labels.Matcher, 0, len(matchers)+1)
+	var own []string
+	possible := c.Values
+	for _, m := range matchers {
+		if m.Name != c.Key {
+			result = append(result, m)
+			continue
+		}
+		var matching []string
+		for _, v := range possible {
+			if m.Matches(v) {
+				matching = append(matching, v)
+			}
+		}
+		own = append(own, m.String())
+		if len(matching) == len(c.Values) {
+			// redundant
+			continue
+		}
+		possible = matching
+		result = append(result, m)
+	}
+	if len(possible) == 0 {
+		return nil, ScopeViolationError{fmt.Sprintf("%s contradicts the scope of the request (%s)", strings.Join(own, ","), c.matcher.String())}
+	}
+	return append(result, c.matcher), nil
+}
+
+// labelWritingFunctions maps functions which write a label named by one of their arguments to the index of that
+// argument
+var labelWritingFunctions = map[string]int{
+	"label_replace": 1,
+	"label_join":    1,
 }
 
-func makeLabelMatcher(key string, values []string) (*metric.LabelMatcher, error) {
+// checkScopeLabelsKept rejects function calls and aggregations writing labels of the constraints, since the results
+// would pretend to belong to a different scope
+func checkScopeLabelsKept(node parser.Node, constraints []constraint) error {
+	var label parser.Expr
+	switch n := node.(type) {
+	case *parser.Call:
+		if i, ok := labelWritingFunctions[n.Func.Name]; ok && len(n.Args) > i {
+			label = n.Args[i]
+		}
+	case *parser.AggregateExpr:
+		if n.Op == parser.COUNT_VALUES {
+			label = n.Param
+		}
+	}
+	name, ok := unwrapParens(label).(*parser.StringLiteral)
+	if !ok {
+		return nil
+	}
+	for _, c := range constraints {
+		if name.Val == c.Key {
+			return ScopeViolationError{fmt.Sprintf("%s must not overwrite the label %s, which restricts the scope of the request", node.String(), c.Key)}
+		}
+	}
+	return nil
+}
+
+// labelCopyingFunctions maps functions which copy the values of labels named by their arguments to these arguments:
+// label_replace(v, dst, replacement, src, regex) has a single source label, label_join(v, dst, separator, src...) any
+// number of them
+var labelCopyingFunctions = map[string]func(args parser.Expressions) parser.Expressions{
+	"label_replace": func(args parser.Expressions) parser.Expressions { return args[3:4] },
+	"label_join":    func(args parser.Expressions) parser.Expressions { return args[3:] },
+}
+
+// LabelNotVisibleError is returned if a query copies the values of labels which are hidden from the user into other
+// labels
+type LabelNotVisibleError struct {
+	Names []string
+}
+
+func (e LabelNotVisibleError) Error() string {
+	return fmt.Sprintf("access to the value of label(s) %s is not permitted", strings.Join(e.Names, ", "))
+}
+
+// CheckLabelsNotCopied rejects expressions using functions like label_replace() to copy the values of hidden labels
+// into other labels, where they would be visible
+func CheckLabelsNotCopied(expression string, hidden func(name string) bool) error {
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		return err
+	}
+
+	var copied []string
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok {
+			return nil
+		}
+		sourceLabels, ok := labelCopyingFunctions[call.Func.Name]
+		if !ok {
+			return nil
+		}
+		for _, arg := range sourceLabels(call.Args) {
+			if name, ok := unwrapParens(arg).(*parser.StringLiteral); ok && hidden(name.Val) {
+				copied = append(copied, name.Val)
+			}
+		}
+		return nil
+	})
+	if len(copied) > 0 {
+		return LabelNotVisibleError{Names: copied}
+	}
+	return nil
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// AddAlternativeLabelConstraintsToExpression enhances a PromQL expression to limit it to series matching at least one
+// of the constraints. Every selector is replaced by the union ("or") of the selectors for the individual constraints.
+// Alternatives contradicting the matchers of the selector are left out. Without constraints, the expression is
+// returned as is (after validation).
+func AddAlternativeLabelConstraintsToExpression(expression string, constraints []LabelConstraint) (string, error) {
+	if len(constraints) == 1 {
+		return AddLabelConstraintToExpression(expression, constraints[0].Key, constraints[0].Values)
+	}
+
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		return "", err
+	}
+	if len(constraints) == 0 {
+		return exprNode.String(), nil
+	}
+	cs := make([]constraint, len(constraints))
+	for i, lc := range constraints {
+		if cs[i], err = newConstraint(lc); err != nil {
+			return "", err
+		}
+	}
+
+	newNode, err := injectAlternatives(exprNode, cs)
+	if err != nil {
+		return "", err
+	}
+	return newNode.String(), nil
+}
+
+// AddAlternativeLabelConstraintsToSelector enhances a PromQL selector to match series matching at least one of the
+// constraints. Since a selector cannot express this, one selector per constraint is returned, except for those
+// contradicting the selector. Without constraints, the selector is returned as is (after validation).
+func AddAlternativeLabelConstraintsToSelector(metricSelector string, constraints []LabelConstraint) ([]string, error) {
+	if len(constraints) == 0 {
+		if _, err := parser.ParseMetricSelector(metricSelector); err != nil {
+			return nil, err
+		}
+		return []string{metricSelector}, nil
+	}
+	var selectors []string
+	var violation error
+	for _, c := range constraints {
+		sel, err := AddLabelConstraintToSelector(metricSelector, c.Key, c.Values)
+		if _, ok := err.(ScopeViolationError); ok {
+			violation = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, sel)
+	}
+	if len(selectors) == 0 {
+		return nil, violation
+	}
+	return selectors, nil
+}
+
+// injectAlternatives copies an expression, replacing each selector with the union of the selector restricted by each
+// of the constraints. Range vectors cannot be combined, so the functions applied to them are duplicated instead. The
+// expressions inside subqueries yield instant vectors, so they are combined before the subquery is evaluated. For the
+// same reason, a range vector queried on its own is turned into a subquery over the union.
+func injectAlternatives(node parser.Expr, constraints []constraint) (parser.Expr, error) {
+	if err := checkScopeLabelsKept(node, constraints); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch e := node.(type) {
+	case *parser.VectorSelector:
+		return union(len(constraints), func(i int) (parser.Expr, error) {
+			return restrictSelector(e, constraints[i])
+		})
+	case *parser.MatrixSelector:
+		return rangeSubquery(e, constraints)
+	case *parser.SubqueryExpr:
+		subquery := *e
+		subquery.Expr, err = injectAlternatives(e.Expr, constraints)
+		return &subquery, err
+	case *parser.Call:
+		hasRange := false
+		for _, arg := range e.Args {
+			_, isRange := arg.(*parser.MatrixSelector)
+			hasRange = hasRange || isRange
+		}
+		if !hasRange {
+			call := *e
+			if call.Args, err = injectAlternativesIntoArgs(e.Args, constraints, nil); err != nil {
+				return nil, err
+			}
+			return &call, nil
+		}
+		alternative := func(i int) (parser.Expr, error) {
+			var err error
+			call := *e
+			call.Args, err = injectAlternativesIntoArgs(e.Args, constraints, &constraints[i])
+			return &call, err
+		}
+		if e.Func.Name == "absent_over_time" {
+			// the series are only absent if they are absent in every alternative
+			return intersection(len(constraints), alternative)
+		}
+		return union(len(constraints), alternative)
+	case *parser.AggregateExpr:
+		agg := *e
+		if agg.Expr, err = injectAlternatives(e.Expr, constraints); err != nil {
+			return nil, err
+		}
+		if e.Param != nil {
+			if agg.Param, err = injectAlternatives(e.Param, constraints); err != nil {
+				return nil, err
+			}
+		}
+		return &agg, nil
+	case *parser.BinaryExpr:
+		bin := *e
+		if bin.LHS, err = injectAlternatives(e.LHS, constraints); err != nil {
+			return nil, err
+		}
+		if bin.RHS, err = injectAlternatives(e.RHS, constraints); err != nil {
+			return nil, err
+		}
+		return &bin, nil
+	case *parser.ParenExpr:
+		paren := *e
+		paren.Expr, err = injectAlternatives(e.Expr, constraints)
+		return &paren, err
+	case *parser.UnaryExpr:
+		unary := *e
+		unary.Expr, err = injectAlternatives(e.Expr, constraints)
+		return &unary, err
+	case *parser.StepInvariantExpr:
+		inv := *e
+		inv.Expr, err = injectAlternatives(e.Expr, constraints)
+		return &inv, err
+	}
+	// literals
+	return node, nil
+}
+
+// injectAlternativesIntoArgs processes function arguments. Range vectors are restricted by rangeConstraint.
+func injectAlternativesIntoArgs(args parser.Expressions, constraints []constraint, rangeConstraint *constraint) (parser.Expressions, error) {
+	result := make(parser.Expressions, len(args))
+	for i, arg := range args {
+		var err error
+		if sel, ok := arg.(*parser.MatrixSelector); ok {
+			newSel := *sel
+			if newSel.VectorSelector, err = restrictSelector(sel.VectorSelector.(*parser.VectorSelector), *rangeConstraint); err != nil {
+				return nil, err
+			}
+			result[i] = &newSel
+			continue
+		}
+		if result[i], err = injectAlternatives(arg, constraints); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// restrictSelector returns a copy of the selector restricted by the constraint
+func restrictSelector(sel *parser.VectorSelector, c constraint) (*parser.VectorSelector, error) {
+	matchers, err := c.restrict(sel.LabelMatchers)
+	if err != nil {
+		return nil, err
+	}
+	newSel := *sel
+	newSel.LabelMatchers = matchers
+	return &newSel, nil
+}
+
+// rangeSubquery replaces a range vector by a subquery over the union of its alternatives. Modifiers of the selector
+// move to the subquery, so that they apply to its range. The subquery samples the union at the default resolution,
+// hence it does not return the raw samples.
+func rangeSubquery(sel *parser.MatrixSelector, constraints []constraint) (parser.Expr, error) {
+	vs := *sel.VectorSelector.(*parser.VectorSelector)
+	subquery := &parser.SubqueryExpr{
+		Range:          sel.Range,
+		OriginalOffset: vs.OriginalOffset,
+		Offset:         vs.Offset,
+		Timestamp:      vs.Timestamp,
+		StartOrEnd:     vs.StartOrEnd,
+	}
+	vs.OriginalOffset, vs.Offset, vs.Timestamp, vs.StartOrEnd = 0, 0, nil, 0
+
+	var err error
+	subquery.Expr, err = injectAlternatives(&vs, constraints)
+	return subquery, err
+}
+
+// union combines the n expressions returned by alternative using the "or" operator. Alternatives violating the scope
+// are left out, unless there are no others.
+func union(n int, alternative func(i int) (parser.Expr, error)) (parser.Expr, error) {
+	return combine(n, alternative, parser.LOR, &parser.VectorMatching{Card: parser.CardManyToMany})
+}
+
+// intersection combines the n expressions returned by alternative using "and on()", i.e. the result of the first
+// alternative is returned if none of them is empty. Alternatives violating the scope are left out, unless there are
+// no others.
+func intersection(n int, alternative func(i int) (parser.Expr, error)) (parser.Expr, error) {
+	return combine(n, alternative, parser.LAND, &parser.VectorMatching{Card: parser.CardManyToMany, On: true})
+}
+
+func combine(n int, alternative func(i int) (parser.Expr, error), op parser.ItemType, matching *parser.VectorMatching) (parser.Expr, error) {
+	var result parser.Expr
+	var violation error
+	for i := 0; i < n; i++ {
+		expr, err := alternative(i)
+		if _, ok := err.(ScopeViolationError); ok {
+			violation = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = expr
+			continue
+		}
+		result = &parser.BinaryExpr{
+			Op:             op,
+			LHS:            result,
+			RHS:            expr,
+			VectorMatching: matching,
+		}
+	}
+	if result == nil {
+		return nil, violation
+	}
+	return &parser.ParenExpr{Expr: result}, nil
+}
+
+func makeLabelMatcher(key string, values []string) (*labels.Matcher, error) {
 	if len(values) == 1 {
-		return metric.NewLabelMatcher(metric.Equal, model.LabelName(key), model.LabelValue(values[0]))
+		return labels.NewMatcher(labels.MatchEqual, key, values[0])
+	}
+	return labels.NewMatcher(labels.MatchRegexp, key, strings.Join(values, "|"))
+}
+
+// matchersString renders label matchers in selector syntax (without the braces)
+func matchersString(matchers []*labels.Matcher) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = m.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// MetricNameFilter restricts the visible metrics by regular expressions on the metric name
+type MetricNameFilter struct {
+	// nil if all metrics are allowed
+	allow *labels.Matcher
+	// nil if no metrics are denied
+	deny *labels.Matcher
+}
+
+// NewMetricNameFilter creates a filter from regular expressions of allowed and denied metric names. An empty
+// expression does not restrict the metrics.
+func NewMetricNameFilter(allow, deny string) (*MetricNameFilter, error) {
+	var f MetricNameFilter
+	var err error
+	if allow != "" {
+		if f.allow, err = labels.NewMatcher(labels.MatchRegexp, labels.MetricName, allow); err != nil {
+			return nil, err
+		}
 	}
-	return metric.NewLabelMatcher(metric.RegexMatch, model.LabelName(key), model.LabelValue(strings.Join(values, "|")))
+	if deny != "" {
+		if f.deny, err = labels.NewMatcher(labels.MatchNotRegexp, labels.MetricName, deny); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
 }
 
-// labelInjector enhances every reference to a metric (vector-selector) with an additional label-constraint
-// We use this to restrict a query to metrics belonging to a single OpenStack tenants stored in label 'project_id'
-type labelInjector struct {
-	promql.Visitor
-	matcher *metric.LabelMatcher
+// Visible checks whether the filter lets a metric pass
+func (f *MetricNameFilter) Visible(name string) bool {
+	return (f.allow == nil || f.allow.Matches(name)) && (f.deny == nil || f.deny.Matches(name))
 }
 
-// Visit does the actual modifications to PromQL expression nodes
-func (v labelInjector) Visit(node promql.Node) (w promql.Visitor) {
-	switch node.(type) {
-	case *promql.MatrixSelector:
-		sel := node.(*promql.MatrixSelector)
-		sel.LabelMatchers = metric.LabelMatchers(append(sel.LabelMatchers, v.matcher))
-	case *promql.VectorSelector:
-		sel := node.(*promql.VectorSelector)
-		sel.LabelMatchers = metric.LabelMatchers(append(sel.LabelMatchers, v.matcher))
+// matchers returns the label matchers enforcing the filter
+func (f *MetricNameFilter) matchers() []*labels.Matcher {
+	var result []*labels.Matcher
+	for _, m := range []*labels.Matcher{f.allow, f.deny} {
+		if m != nil {
+			result = append(result, m)
+		}
 	}
+	return result
+}
+
+// MetricNotVisibleError is returned if a query or selector only refers to metrics hidden by a MetricNameFilter
+type MetricNotVisibleError struct {
+	Names []string
+}
 
-	return v
+func (e MetricNotVisibleError) Error() string {
+	return fmt.Sprintf("access to metric(s) %s is not permitted", strings.Join(e.Names, ", "))
+}
+
+// AddMetricNameFilterToExpression restricts every selector of a PromQL expression to the metrics visible through the
+// filter. If all selectors refer to hidden metrics by name, a MetricNotVisibleError is returned.
+func AddMetricNameFilterToExpression(expression string, filter *MetricNameFilter) (string, error) {
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		return "", err
+	}
+
+	selectors := 0
+	var denied []string
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		sel, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		selectors++
+		name, hasName := metricName(sel.LabelMatchers)
+		if hasName && filter.Visible(name) {
+			// nothing to restrict
+			return nil
+		}
+		if hasName {
+			denied = append(denied, name)
+		}
+		// a metric name in front of the braces must not be combined with further __name__ matchers
+		sel.Name = ""
+		sel.LabelMatchers = append(sel.LabelMatchers, filter.matchers()...)
+		return nil
+	})
+	if selectors > 0 && len(denied) == selectors {
+		return "", MetricNotVisibleError{Names: denied}
+	}
+
+	return exprNode.String(), nil
+}
+
+// AddMetricNameFilterToSelector restricts a series selector to the metrics visible through the filter. If the
+// selector refers to a hidden metric by name, a MetricNotVisibleError is returned.
+func AddMetricNameFilterToSelector(metricSelector string, filter *MetricNameFilter) (string, error) {
+	var labelMatchers []*labels.Matcher
+	var err error
+	if metricSelector != "{}" {
+		labelMatchers, err = parser.ParseMetricSelector(metricSelector)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name, hasName := metricName(labelMatchers)
+	if hasName && !filter.Visible(name) {
+		return "", MetricNotVisibleError{Names: []string{name}}
+	} else if hasName {
+		return metricSelector, nil
+	}
+	return "{" + matchersString(append(labelMatchers, filter.matchers()...)) + "}", nil
+}
+
+// metricName returns the metric name if the matchers select a single one
+func metricName(matchers []*labels.Matcher) (string, bool) {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value, true
+		}
+	}
+	return "", false
 }
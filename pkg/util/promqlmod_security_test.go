@@ -0,0 +1,177 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// hostileQueries try to obtain series from outside of the scope. Each of them must either be rejected or be
+// restricted by the rewriting.
+var hostileQueries = []string{
+	`up`,
+	`{__name__=~".+"}`,
+	`{__name__=~".+",project_id=~".*"}`,
+	`up{project_id=~".+"}`,
+	`up{project_id=~".*"}`,
+	`up{project_id!=""}`,
+	`up{project_id=""}`,
+	`up{project_id="p3"}`,
+	`up{project_id!="p1"}`,
+	`up{project_id!~"p1|p2"}`,
+	`up{project_id=~"p1|p3"}`,
+	`up{project_id=~"P1"}`,
+	`up{project_id=~"(?i)P1"}`,
+	`up{domain_id="d2"}`,
+	`up{domain_id="d2",project_id="p3"}`,
+	`(((up{project_id=~".*"})))`,
+	`-up`,
+	`up or on() vector(1)`,
+	`up or up{project_id="p3"}`,
+	`up unless up{project_id="p3"}`,
+	`up * on(job) group_left(project_id) up{project_id!~"p1"}`,
+	`absent(up{project_id="p3"})`,
+	`absent_over_time(up{project_id="p3"}[5m])`,
+	`label_replace(up, "project_id", "p3", "", "")`,
+	`label_replace(up, ("project_id"), "p3", "", "")`,
+	`label_replace(up, "domain_id", "d2", "", "")`,
+	`label_join(up, "project_id", ",", "job")`,
+	`label_replace(up, "tenant", "$1", "project_id", "(.*)")`,
+	`count_values("project_id", up)`,
+	`count_values("domain_id", up)`,
+	`sum by (project_id) (rate(http_requests_total{project_id=~".*"}[5m]))`,
+	`sort_desc(topk(1, up{project_id=~".*"}))`,
+	`histogram_quantile(0.9, sum by (le) (rate(request_duration_seconds_bucket{project_id=~"p1|p3"}[5m])))`,
+	`max_over_time(rate(up{project_id=~".*"}[5m])[1h:1m])`,
+	`max_over_time(deriv(rate(up[1m])[5m:1m])[10m:] @ start())`,
+	`up{project_id=~".*"} offset -1h`,
+	`quantile_over_time(0.9, up{project_id!="p1"}[1h] @ 1609746000)`,
+	`timestamp(up{project_id=~".*"})`,
+	`vector(1)`,
+	`scalar(up{project_id="p3"})`,
+}
+
+// probeValues are values of the scope labels that do not belong to the scope
+var probeValues = []string{"", "p3", "d2", "P1", "p1p2", "p1|p2", ".*", "other"}
+
+// assertRestricted verifies that every selector of the expression only matches series within one of the constraints
+// and that no scope labels are overwritten
+func assertRestricted(t *testing.T, query, expression string, constraints []LabelConstraint) {
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		t.Errorf("%s: rewritten query %s is invalid: %s", query, expression, err)
+		return
+	}
+
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		sel, ok := node.(*parser.VectorSelector)
+		if !ok {
+			if checkScopeLabelsKept(node, makeConstraints(t, constraints)) != nil {
+				t.Errorf("%s: %s overwrites a scope label in %s", query, node, expression)
+			}
+			return nil
+		}
+		for _, c := range constraints {
+			if restrictedBy(sel.LabelMatchers, c) {
+				return nil
+			}
+		}
+		t.Errorf("%s: selector %s escapes the scope in %s", query, sel, expression)
+		return nil
+	})
+}
+
+// restrictedBy checks whether the matchers only admit values of the constraint
+func restrictedBy(matchers []*labels.Matcher, c LabelConstraint) bool {
+	for _, m := range matchers {
+		if m.Name != c.Key || (m.Type != labels.MatchEqual && m.Type != labels.MatchRegexp) {
+			continue
+		}
+		escapes := false
+		for _, v := range probeValues {
+			escapes = escapes || m.Matches(v)
+		}
+		if !escapes {
+			return true
+		}
+	}
+	return false
+}
+
+func makeConstraints(t *testing.T, constraints []LabelConstraint) []constraint {
+	result := make([]constraint, len(constraints))
+	for i, lc := range constraints {
+		var err error
+		if result[i], err = newConstraint(lc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+func TestScopeIsolation_expressions(t *testing.T) {
+	scopes := map[string][]LabelConstraint{
+		"project":            {{Key: "project_id", Values: []string{"p1"}}},
+		"project tree":       {{Key: "project_id", Values: []string{"p1", "p2"}}},
+		"domain":             {{Key: "domain_id", Values: []string{"d1"}}},
+		"domain or projects": alternatives,
+	}
+	for scopeName, constraints := range scopes {
+		for _, query := range hostileQueries {
+			result, err := AddAlternativeLabelConstraintsToExpression(query, constraints)
+			if err != nil {
+				// rejected queries cannot escape
+				continue
+			}
+			assertRestricted(t, scopeName+": "+query, result, constraints)
+		}
+	}
+}
+
+func TestScopeIsolation_selectors(t *testing.T) {
+	selectors := []string{
+		`{}`,
+		`{__name__=~".+"}`,
+		`{project_id=~".*"}`,
+		`{project_id!="p1"}`,
+		`{project_id="p3"}`,
+		`{domain_id=~".+",project_id=~".+"}`,
+		`up{project_id=~"(?i)P1"}`,
+	}
+	for _, sel := range selectors {
+		result, err := AddAlternativeLabelConstraintsToSelector(sel, alternatives)
+		if err != nil {
+			continue
+		}
+		for _, newSel := range result {
+			matchers, err := parser.ParseMetricSelector(newSel)
+			if err != nil {
+				t.Errorf("%s: rewritten selector %s is invalid: %s", sel, newSel, err)
+				continue
+			}
+			if !restrictedBy(matchers, alternatives[0]) && !restrictedBy(matchers, alternatives[1]) {
+				t.Errorf("%s: rewritten selector %s escapes the scope", sel, newSel)
+			}
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package util
 
 import (
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 const expectedSelector = "{check=~\"$api\",project_id=\"ecdc9fc4165d49b78987bbfbd5b4c9e2\"}"
@@ -17,6 +22,64 @@ func TestAddLabelConstraintToExpression(t *testing.T) {
 	}
 }
 
+// queryCorpus contains real-world queries (taken from dashboards and alerting rules) together with the expected result
+// of restricting them to project p1
+var queryCorpus = []struct {
+	name     string
+	query    string
+	expected string
+}{
+	{"plain metric", "up", "up{project_id=\"p1\"}"},
+	{"metric with matchers", "up{instance=~\"web.*\",job=\"node\"}", "up{instance=~\"web.*\",job=\"node\",project_id=\"p1\"}"},
+	{"selector without metric name", "{__name__=~\"openstack_.*\",job=\"exporter\"}", "{__name__=~\"openstack_.*\",job=\"exporter\",project_id=\"p1\"}"},
+	{"rate", "rate(http_requests_total{job=\"api\"}[5m])", "rate(http_requests_total{job=\"api\",project_id=\"p1\"}[5m])"},
+	{"aggregation with grouping", "sum by (code) (rate(http_requests_total[5m]))", "sum by (code) (rate(http_requests_total{project_id=\"p1\"}[5m]))"},
+	{"aggregation without", "avg without (instance) (node_load1)", "avg without (instance) (node_load1{project_id=\"p1\"})"},
+	{"histogram quantile", "histogram_quantile(0.99, sum by (le) (rate(request_duration_seconds_bucket[5m])))", "histogram_quantile(0.99, sum by (le) (rate(request_duration_seconds_bucket{project_id=\"p1\"}[5m])))"},
+	{"binary expression", "node_filesystem_free_bytes / node_filesystem_size_bytes * 100 < 10", "node_filesystem_free_bytes{project_id=\"p1\"} / node_filesystem_size_bytes{project_id=\"p1\"} * 100 < 10"},
+	{"comparison with bool", "up == bool 0", "up{project_id=\"p1\"} == bool 0"},
+	{"unary minus", "-delta(temperature[1h])", "-delta(temperature{project_id=\"p1\"}[1h])"},
+	{"topk", "topk(5, openstack_compute_instances_gauge)", "topk(5, openstack_compute_instances_gauge{project_id=\"p1\"})"},
+	{"label_replace", "label_replace(up, \"host\", \"$1\", \"instance\", \"(.*):.*\")", "label_replace(up{project_id=\"p1\"}, \"host\", \"$1\", \"instance\", \"(.*):.*\")"},
+	{"offset", "rate(a[5m] offset 1d)", "rate(a{project_id=\"p1\"}[5m] offset 1d)"},
+	{"negative offset", "a offset -5m", "a{project_id=\"p1\"} offset -5m"},
+	{"@ timestamp", "a @ 1609746000", "a{project_id=\"p1\"} @ 1609746000.000"},
+	{"@ start", "rate(a[5m] @ start())", "rate(a{project_id=\"p1\"}[5m] @ start())"},
+	{"subquery", "max_over_time(rate(a[5m])[1h:1m])", "max_over_time(rate(a{project_id=\"p1\"}[5m])[1h:1m])"},
+	{"subquery with default step", "min_over_time(sum(a)[30m:])", "min_over_time(sum(a{project_id=\"p1\"})[30m:])"},
+	{"nested subquery", "max_over_time(deriv(rate(a[1m])[5m:1m])[10m:])", "max_over_time(deriv(rate(a{project_id=\"p1\"}[1m])[5m:1m])[10m:])"},
+	{"newer function", "quantile_over_time(0.9, a[1h]) - last_over_time(b[5m])", "quantile_over_time(0.9, a{project_id=\"p1\"}[1h]) - last_over_time(b{project_id=\"p1\"}[5m])"},
+	{"absent", "absent(up{job=\"api\"})", "absent(up{job=\"api\",project_id=\"p1\"})"},
+	{"range vector", "up[5m]", "up{project_id=\"p1\"}[5m]"},
+	{"range vector with offset", "up[5m] offset 1h", "up{project_id=\"p1\"}[5m] offset 1h"},
+	{"absent_over_time", "absent_over_time(up{job=\"api\"}[5m])", "absent_over_time(up{job=\"api\",project_id=\"p1\"}[5m])"},
+}
+
+func TestAddLabelConstraintToExpression_corpus(t *testing.T) {
+	for _, c := range queryCorpus {
+		result, err := AddLabelConstraintToExpression(c.query, "project_id", []string{"p1"})
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else if result != c.expected {
+			t.Errorf("%s: unexpected result: %s; should have been %s", c.name, result, c.expected)
+		}
+	}
+}
+
+func TestAddAlternativeLabelConstraintsToExpression_corpus(t *testing.T) {
+	// all queries of the corpus have to survive rewriting with several constraints as well
+	for _, c := range queryCorpus {
+		result, err := AddAlternativeLabelConstraintsToExpression(c.query, alternatives)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if _, err := parser.ParseExpr(result); err != nil {
+			t.Errorf("%s: rewritten query %s is invalid: %s", c.name, result, err)
+		}
+	}
+}
+
 func TestAddLabelConstraintToSelector(t *testing.T) {
 	result, err := AddLabelConstraintToSelector("{check=~\"$api\"}", "project_id", []string{"ecdc9fc4165d49b78987bbfbd5b4c9e2"})
 	if err != nil {
@@ -34,3 +97,207 @@ func TestAddLabelConstraintToSelector_multi(t *testing.T) {
 		t.Errorf("Unexpected result: %s; should have been %s", result, expectedSelectorMulti)
 	}
 }
+
+var alternatives = []LabelConstraint{{Key: "domain_id", Values: []string{"d1"}}, {Key: "project_id", Values: []string{"p1", "p2"}}}
+
+func TestAddAlternativeLabelConstraintsToExpression(t *testing.T) {
+	cases := map[string]string{
+		"up": "(up{domain_id=\"d1\"} or up{project_id=~\"p1|p2\"})",
+		"sum(rate(http_requests{code=\"500\"}[5m])) by (code)": "sum by (code) ((rate(http_requests{code=\"500\",domain_id=\"d1\"}[5m]) or rate(http_requests{code=\"500\",project_id=~\"p1|p2\"}[5m])))",
+		"topk(3, a) / 2":                    "topk(3, (a{domain_id=\"d1\"} or a{project_id=~\"p1|p2\"})) / 2",
+		"max_over_time(rate(a[5m])[1h:1m])": "max_over_time((rate(a{domain_id=\"d1\"}[5m]) or rate(a{project_id=~\"p1|p2\"}[5m]))[1h:1m])",
+		"a @ end() offset -5m":              "(a{domain_id=\"d1\"} @ end() offset -5m or a{project_id=~\"p1|p2\"} @ end() offset -5m)",
+		"up[5m]":                            "(up{domain_id=\"d1\"} or up{project_id=~\"p1|p2\"})[5m:]",
+		"up[5m] offset 1h":                  "(up{domain_id=\"d1\"} or up{project_id=~\"p1|p2\"})[5m:] offset 1h",
+		"a[5m] @ 100":                       "(a{domain_id=\"d1\"} or a{project_id=~\"p1|p2\"})[5m:] @ 100.000",
+		"absent_over_time(a[5m])":           "(absent_over_time(a{domain_id=\"d1\"}[5m]) and on () absent_over_time(a{project_id=~\"p1|p2\"}[5m]))",
+		"absent(a)":                         "absent((a{domain_id=\"d1\"} or a{project_id=~\"p1|p2\"}))",
+	}
+	for expr, expected := range cases {
+		result, err := AddAlternativeLabelConstraintsToExpression(expr, alternatives)
+		if err != nil {
+			t.Error(err)
+		} else if result != expected {
+			t.Errorf("Unexpected result: %s; should have been %s", result, expected)
+		}
+	}
+}
+
+func TestAddAlternativeLabelConstraintsToSelector(t *testing.T) {
+	result, err := AddAlternativeLabelConstraintsToSelector("{check=~\"$api\"}", alternatives)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 2 || result[0] != "{check=~\"$api\",domain_id=\"d1\"}" || result[1] != "{check=~\"$api\",project_id=~\"p1|p2\"}" {
+		t.Errorf("Unexpected result: %v", result)
+	}
+}
+
+// selectorMatchers lists the matchers of all selectors in an expression (sorted, since the order is not relevant)
+func selectorMatchers(t *testing.T, expression string) []string {
+	exprNode, err := parser.ParseExpr(expression)
+	if err != nil {
+		t.Fatalf("rewritten query %s is invalid: %s", expression, err)
+	}
+	var result []string
+	parser.Inspect(exprNode, func(node parser.Node, _ []parser.Node) error {
+		if sel, ok := node.(*parser.VectorSelector); ok {
+			matchers := make([]string, len(sel.LabelMatchers))
+			for i, m := range sel.LabelMatchers {
+				matchers[i] = m.String()
+			}
+			sort.Strings(matchers)
+			result = append(result, strings.Join(matchers, ","))
+		}
+		return nil
+	})
+	return result
+}
+
+func TestAddMetricNameFilterToExpression(t *testing.T) {
+	filter, err := NewMetricNameFilter("openstack_.*|billing_.*", "billing_.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"openstack_compute_instances", []string{`__name__="openstack_compute_instances"`}},
+		{"sum(rate({job=\"exporter\"}[5m]))", []string{`__name__!~"billing_.*",__name__=~"openstack_.*|billing_.*",job="exporter"`}},
+		{"billing_invoices + on (project_id) openstack_compute_instances", []string{
+			`__name__!~"billing_.*",__name__="billing_invoices",__name__=~"openstack_.*|billing_.*"`,
+			`__name__="openstack_compute_instances"`}},
+		{"max_over_time(rate({job=\"api\"}[5m])[1h:])", []string{`__name__!~"billing_.*",__name__=~"openstack_.*|billing_.*",job="api"`}},
+		{"vector(1)", nil},
+	}
+	for _, c := range cases {
+		result, err := AddMetricNameFilterToExpression(c.query, filter)
+		if err != nil {
+			t.Errorf("%s: %s", c.query, err)
+			continue
+		}
+		if matchers := selectorMatchers(t, result); !reflect.DeepEqual(matchers, c.expected) {
+			t.Errorf("%s: unexpected selectors %v; should have been %v", c.query, matchers, c.expected)
+		}
+	}
+
+	_, err = AddMetricNameFilterToExpression("sum(billing_invoices) / count(billing_invoices)", filter)
+	if _, ok := err.(MetricNotVisibleError); !ok {
+		t.Errorf("Expected MetricNotVisibleError for query referencing only denied metrics, got %v", err)
+	}
+}
+
+func TestAddMetricNameFilterToSelector(t *testing.T) {
+	filter, err := NewMetricNameFilter("", "billing_.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"up":                                     "up",
+		"{component!=\"\"}":                      "{component!=\"\",__name__!~\"billing_.*\"}",
+		"{__name__=~\"openstack_.*\",job=\"x\"}": "{__name__=~\"openstack_.*\",job=\"x\",__name__!~\"billing_.*\"}",
+	}
+	for sel, expected := range cases {
+		result, err := AddMetricNameFilterToSelector(sel, filter)
+		if err != nil {
+			t.Error(err)
+		} else if result != expected {
+			t.Errorf("Unexpected result: %s; should have been %s", result, expected)
+		}
+	}
+
+	if _, err := AddMetricNameFilterToSelector("{__name__=\"billing_invoices\"}", filter); err == nil {
+		t.Error("Expected error for selector of denied metric")
+	}
+}
+
+func TestAddLabelConstraintToExpression_scopeMatchers(t *testing.T) {
+	values := []string{"p1", "p2"}
+	cases := map[string]string{
+		// redundant matchers are removed
+		"up{project_id=~\".+\"}":       "up{project_id=~\"p1|p2\"}",
+		"up{project_id!=\"\"}":         "up{project_id=~\"p1|p2\"}",
+		"up{project_id=~\"p1|p2|p3\"}": "up{project_id=~\"p1|p2\"}",
+		// others narrow the scope down
+		"up{project_id=\"p1\"}":  "up{project_id=\"p1\",project_id=~\"p1|p2\"}",
+		"up{project_id!=\"p1\"}": "up{project_id!=\"p1\",project_id=~\"p1|p2\"}",
+	}
+	for expr, expected := range cases {
+		result, err := AddLabelConstraintToExpression(expr, "project_id", values)
+		if err != nil {
+			t.Errorf("%s: %s", expr, err)
+		} else if result != expected {
+			t.Errorf("Unexpected result: %s; should have been %s", result, expected)
+		}
+	}
+
+	rejected := []string{
+		"up{project_id=\"p3\"}",
+		"up{project_id=\"\"}",
+		"up{project_id!~\"p1|p2\"}",
+		"up{project_id=\"p1\",project_id=\"p2\"}",
+		"label_replace(up, \"project_id\", \"p3\", \"\", \"\")",
+		"label_join(up, \"project_id\", \",\", \"job\")",
+		"count_values(\"project_id\", up)",
+	}
+	for _, expr := range rejected {
+		if _, err := AddLabelConstraintToExpression(expr, "project_id", values); err == nil {
+			t.Errorf("%s: expected to be rejected", expr)
+		} else if _, ok := err.(ScopeViolationError); !ok {
+			t.Errorf("%s: expected ScopeViolationError, got %v", expr, err)
+		}
+	}
+}
+
+func TestAddAlternativeLabelConstraintsToExpression_scopeMatchers(t *testing.T) {
+	// alternatives contradicting the selector are left out
+	result, err := AddAlternativeLabelConstraintsToExpression("up{project_id=\"p3\"}", alternatives)
+	if err != nil {
+		t.Error(err)
+	} else if matchers := selectorMatchers(t, result); !reflect.DeepEqual(matchers, []string{`__name__="up",domain_id="d1",project_id="p3"`}) {
+		t.Errorf("Unexpected result: %s", result)
+	}
+
+	if _, err := AddAlternativeLabelConstraintsToExpression("up{domain_id=\"d2\",project_id=\"p3\"}", alternatives); err == nil {
+		t.Error("Expected error for selector contradicting all alternatives")
+	}
+}
+
+func TestAddAlternativeLabelConstraintsToSelector_scopeMatchers(t *testing.T) {
+	result, err := AddAlternativeLabelConstraintsToSelector("{project_id=~\"p.*\"}", alternatives)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 2 || result[0] != "{project_id=~\"p.*\",domain_id=\"d1\"}" || result[1] != "{project_id=~\"p1|p2\"}" {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	if _, err := AddAlternativeLabelConstraintsToSelector("{domain_id=\"d2\",project_id=\"p3\"}", alternatives); err == nil {
+		t.Error("Expected error for selector contradicting all alternatives")
+	}
+}
+
+func TestCheckLabelsNotCopied(t *testing.T) {
+	hidden := func(name string) bool { return name == "instance" }
+	for _, expr := range []string{
+		"label_replace(up, \"host\", \"$1\", \"instance\", \"(.*):.*\")",
+		"sum by (host) (label_join(up, \"host\", \"-\", \"job\", (\"instance\")))",
+	} {
+		if err := CheckLabelsNotCopied(expr, hidden); err == nil {
+			t.Errorf("%s: expected error for copied label", expr)
+		} else if _, ok := err.(LabelNotVisibleError); !ok {
+			t.Errorf("%s: unexpected error %s", expr, err)
+		}
+	}
+	// the hidden label may still be the target or be used for selection, and the regex is no label name
+	for _, expr := range []string{
+		"label_replace(up{instance=\"a\"}, \"instance\", \"$1\", \"job\", \"(.*)\")",
+		"label_replace(up, \"host\", \"$1\", \"job\", \"instance\")",
+		"label_join(up, \"host\", \"-\")",
+	} {
+		if err := CheckLabelsNotCopied(expr, hidden); err != nil {
+			t.Errorf("%s: unexpected error %s", expr, err)
+		}
+	}
+}
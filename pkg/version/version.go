@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2017 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package version
+
+import (
+	"runtime"
+)
+
+// The following variables are injected by the linker (see Makefile), e.g.
+// go build -ldflags "-X github.com/sapcc/maia/pkg/version.Version=1.0.0"
+var (
+	// Version is the semantic version of the Maia build
+	Version = "dev"
+	// Revision is the git commit the binary has been built from
+	Revision = "unknown"
+	// Branch is the git branch the binary has been built from
+	Branch = "unknown"
+	// BuildUser is the user@host who built the binary
+	BuildUser = "unknown"
+	// BuildDate is the timestamp of the build
+	BuildDate = "unknown"
+)
+
+// GoVersion is the version of the Go compiler used to build the binary
+var GoVersion = runtime.Version()
+
+// Info contains the build information in a Prometheus-compatible format (see /api/v1/status/buildinfo)
+type Info struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// BuildInfo returns the build information of this binary
+func BuildInfo() Info {
+	return Info{
+		Version:   Version,
+		Revision:  Revision,
+		Branch:    Branch,
+		BuildUser: BuildUser,
+		BuildDate: BuildDate,
+		GoVersion: GoVersion,
+	}
+}
@@ -31,6 +31,9 @@ Prometheus.Graph.stepValues = [
   "1w", "2w", "4w", "8w", "1y", "2y"
 ];
 
+// Native histograms are displayed as these quantiles instead of their buckets.
+Prometheus.Graph.histogramQuantiles = [0.5, 0.9, 0.99];
+
 Prometheus.Graph.numGraphs = 0;
 
 Prometheus.Graph.prototype.initialize = function() {
@@ -438,7 +441,7 @@ Prometheus.Graph.prototype.submitQuery = function() {
         var duration = new Date().getTime() - startTime;
         var totalTimeSeries = 0;
         if (xhr.responseJSON.data !== undefined) {
-          if (xhr.responseJSON.data.resultType === "scalar") {
+          if (xhr.responseJSON.data.resultType === "scalar" || xhr.responseJSON.data.resultType === "string") {
             totalTimeSeries = 1;
           } else {
             totalTimeSeries = xhr.responseJSON.data.result.length;
@@ -510,6 +513,37 @@ Prometheus.Graph.prototype.parseValue = function(value) {
   return val;
 };
 
+// Estimates a quantile of a native histogram by linear interpolation within the
+// bucket containing it. Buckets are [boundaries, lower, upper, count].
+Prometheus.Graph.prototype.histogramQuantile = function(q, histogram) {
+  var count = parseFloat(histogram.count);
+  var buckets = histogram.buckets || [];
+  if (count === 0 || buckets.length === 0) {
+    return null;
+  }
+  var rank = q * count;
+  var cumulative = 0;
+  for (var i = 0; i < buckets.length; i++) {
+    var lower = parseFloat(buckets[i][1]);
+    var upper = parseFloat(buckets[i][2]);
+    var bucketCount = parseFloat(buckets[i][3]);
+    if (bucketCount > 0 && cumulative + bucketCount >= rank) {
+      return lower + (upper - lower) * (rank - cumulative) / bucketCount;
+    }
+    cumulative += bucketCount;
+  }
+  return parseFloat(buckets[buckets.length - 1][2]);
+};
+
+Prometheus.Graph.prototype.histogramToText = function(histogram) {
+  var self = this;
+  var parts = ["count: " + histogram.count, "sum: " + histogram.sum];
+  Prometheus.Graph.histogramQuantiles.forEach(function(q) {
+    parts.push("p" + Math.round(q * 100) + ": " + self.histogramQuantile(q, histogram));
+  });
+  return parts.join(", ");
+};
+
 Prometheus.Graph.prototype.transformData = function(json) {
   var self = this;
   var palette = new Rickshaw.Color.Palette();
@@ -517,7 +551,8 @@ Prometheus.Graph.prototype.transformData = function(json) {
     self.showError("Result is not of matrix type! Please enter a correct expression.");
     return [];
   }
-  var data = json.result.map(function(ts) {
+  var data = [];
+  json.result.forEach(function(ts) {
     var name;
     var labels;
     if (ts.metric === null) {
@@ -527,17 +562,35 @@ Prometheus.Graph.prototype.transformData = function(json) {
       name = escapeHTML(self.metricToTsName(ts.metric));
       labels = ts.metric;
     }
-    return {
-      name: name,
-      labels: labels,
-      data: ts.values.map(function(value) {
-        return {
-          x: value[0],
-          y: self.parseValue(value[1])
-        };
-      }),
-      color: palette.color()
-    };
+    if (ts.values !== undefined || ts.histograms === undefined) {
+      data.push({
+        name: name,
+        labels: labels,
+        data: (ts.values || []).map(function(value) {
+          return {
+            x: value[0],
+            y: self.parseValue(value[1])
+          };
+        }),
+        color: palette.color()
+      });
+    }
+    // Native histograms are graphed as one series per quantile.
+    if (ts.histograms !== undefined) {
+      Prometheus.Graph.histogramQuantiles.forEach(function(q) {
+        data.push({
+          name: name + " p" + Math.round(q * 100),
+          labels: labels,
+          data: ts.histograms.map(function(value) {
+            return {
+              x: value[0],
+              y: self.histogramQuantile(q, value[1])
+            };
+          }),
+          color: palette.color()
+        });
+      });
+    }
   });
   data.forEach(function(s) {
     // Insert nulls for all missing steps.
@@ -716,7 +769,8 @@ Prometheus.Graph.prototype.handleConsoleResponse = function(data, textStatus) {
     for (var i = 0; i < data.result.length; i++) {
       var s = data.result[i];
       var tsName = self.metricToTsName(s.metric);
-      tBody.append("<tr><td>" + escapeHTML(tsName) + "</td><td>" + s.value[1] + "</td></tr>");
+      var valueText = s.histogram !== undefined ? self.histogramToText(s.histogram[1]) : s.value[1];
+      tBody.append("<tr><td>" + escapeHTML(tsName) + "</td><td>" + valueText + "</td></tr>");
     }
     break;
   case "matrix":
@@ -728,8 +782,13 @@ Prometheus.Graph.prototype.handleConsoleResponse = function(data, textStatus) {
       var v = data.result[i];
       var tsName = self.metricToTsName(v.metric);
       var valueText = "";
-      for (var j = 0; j < v.values.length; j++) {
-        valueText += v.values[j][1] + " @" + v.values[j][0] + "<br/>";
+      var values = v.values || [];
+      for (var j = 0; j < values.length; j++) {
+        valueText += values[j][1] + " @" + values[j][0] + "<br/>";
+      }
+      var histograms = v.histograms || [];
+      for (var j = 0; j < histograms.length; j++) {
+        valueText += self.histogramToText(histograms[j][1]) + " @" + histograms[j][0] + "<br/>";
       }
       tBody.append("<tr><td>" + escapeHTML(tsName) + "</td><td>" + valueText + "</td></tr>");
     }